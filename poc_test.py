@@ -17,6 +17,11 @@ reinsurer2_hl_creds = ("reinsurer2", "RmMio3LCk37J")
 insurer2_hl_creds = ("insurer2", "1wtM0CXjIVXr")
 reinsurer3_hl_creds = ("reinsurer3", "atjQRL2S6FJx")
 
+# TCert attributes requested on user transactions. The affiliation makes the
+# org principal of the user available, so rights given to "org:<affiliation>"
+# apply to it.
+user_attrs = ["enrollmentId", "affiliation"]
+
 cch = "CHAINCODE"
 am = "asset_management"
 rr = "reinsurance_request"
@@ -65,6 +70,9 @@ def system_test():
     ## Accept reinsure1 proposal
     accept(config, "insurer1", ri1prop, "reinsurer1")
 
+    ## Address a request to reinsurer2's organization rather than to the user
+    submit_to_org(config, "org:reinsurer_b", "reinsurer2", "reinsurer1")
+
     print("System Test COMPLETE")
     exit(1)
 
@@ -86,7 +94,7 @@ def submit(config):
                 ]
             },
             "secureContext": "insurer1",
-            "attributes": ["enrollmentId"]
+            "attributes": user_attrs
         },
         "id": 1
     }
@@ -133,6 +141,51 @@ def submit(config):
     return last
 
 
+## submit a request to an organization, verify its member can view it and an
+## outsider cannot, return the submission id
+def submit_to_org(config, org, member, outsider):
+    print("submit_to_org() [{0}]".format(org))
+    before = to_json(get_user_assets(config, "insurer1"))['submissions'].keys()
+    data = {
+        "jsonrpc": "2.0",
+        "method": "invoke",
+        "params": {
+            "type": 1,
+            "chaincodeID": {
+                "name": config[cch][rr]
+            },
+            "ctorMsg": {
+                "function": "submit",
+                "args": [
+                    org, "2e1b1b0cb7bfce4cf47706752a234f29", "http://mybucket.s3-website-us-east-1.amazonaws.com/", "some excel contract text here", "CREATE ABSTRACT TABLE insuredItem (foo INT);", "1"
+                ]
+            },
+            "secureContext": "insurer1",
+            "attributes": user_attrs
+        },
+        "id": 1
+    }
+
+    assert_post(data)
+    time.sleep(2) ## TODO try to avoid a sleep
+
+    keys = [k for k in to_json(get_user_assets(config, "insurer1"))['submissions'].keys() if k not in before]
+    assert len(keys) == 1
+    subId = keys[0]
+
+    ## The member sees the request through its organization
+    submission = to_json(get_submission(config, "insurer1", subId))
+    assert submission == to_json(get_submission(config, member, subId))
+    ua = to_json(get_user_assets(config, member))
+    assert subId in ua['requests']
+
+    ## Users outside the organization do not
+    r = get_submission(config, outsider, subId, post)
+    assert 'error' in r
+    assert 'Insuffienct rights on asset' in r['error']['data']
+
+    return subId
+
 def get_submission(config, user, id, poster=None):
     print("get_submission() [{0}, {1}]".format(user, id))
     data = {
@@ -150,7 +203,7 @@ def get_submission(config, user, id, poster=None):
                 ]
             },
             "secureContext": user,
-            "attributes": ["enrollmentId"]
+            "attributes": user_attrs
         },
         "id": 3
     }
@@ -180,7 +233,7 @@ def propose(config, user, requestId, requestUser):
                 ]
             },
             "secureContext": user,
-            "attributes": ["enrollmentId"]
+            "attributes": user_attrs
         },
         "id": 2
     }
@@ -243,7 +296,7 @@ def get_proposal(config, user, id, poster=None):
                 ]
             },
             "secureContext": user,
-            "attributes": ["enrollmentId"]
+            "attributes": user_attrs
         },
         "id": 3
     }
@@ -271,7 +324,7 @@ def counter(config, user, propId, userB):
                 ]
             },
             "secureContext": user,
-            "attributes": ["enrollmentId"]
+            "attributes": user_attrs
         },
         "id": 2
     }
@@ -317,7 +370,7 @@ def accept(config, user, propId, acceptedUser):
                 ]
             },
             "secureContext": user,
-            "attributes": ["enrollmentId"]
+            "attributes": user_attrs
         },
         "id": 2
     }
@@ -361,7 +414,7 @@ def post_reject(config, user, propId, poster):
                 ]
             },
             "secureContext": user,
-            "attributes": ["enrollmentId"]
+            "attributes": user_attrs
         },
         "id": 2
     }
@@ -410,7 +463,7 @@ def get_user_assets(config, user):
                 ]
             },
             "secureContext": user,
-            "attributes": ["enrollmentId"]
+            "attributes": user_attrs
         },
         "id": 3
     }
@@ -434,7 +487,7 @@ def get_asset_rights(config, user, asset):
                 ]
             },
             "secureContext": user,
-            "attributes": ["enrollmentId"]
+            "attributes": user_attrs
         },
         "id": 3
     }
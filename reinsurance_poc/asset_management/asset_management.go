@@ -1,8 +1,10 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -14,18 +16,51 @@ var logger = shim.NewLogger("AssetManagementCC")
 
 var am = AssetManager{}
 var um = UserManager{}
+var pm = PolicyManager{}
+var hm = HistoryManager{}
+var mm = MandateManager{}
+var rm = RegistryManager{}
 
 type AssetManagementCC struct {
 }
 
+// Role to assign to a party of an asset
+type partyRole struct {
+	id   string
+	role string
+}
+
 func (t *AssetManagementCC) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 	logger.Debug("Init Chaincode...")
 
 	am.Init(stub)
 	um.Init(stub)
+	hm.Init(stub)
+	mm.Init(stub)
+	rm.Init(stub)
+
+	if len(args) > 2 {
+		return nil, errors.New("Init expects at most 2 args ['delegableRights,..', 'auditors,..']")
+	}
+
+	var delegable []common.AssetRight
+	if len(args) > 0 && args[0] != "" {
+		rights, err := common.ParseAssetRights(args[0])
+		if err != nil {
+			return nil, err
+		}
+		delegable = rights
+	}
+
+	var auditors []string
+	if len(args) == 2 && args[1] != "" {
+		auditors = strings.Split(args[1], ",")
+	}
 
-	if len(args) != 0 {
-		return nil, errors.New("Init does not support arguments")
+	err := pm.Init(stub, delegable, auditors)
+	if err != nil {
+		logger.Error(err)
+		return nil, errors.New("Failed to init asset management policy")
 	}
 
 	logger.Debug("Init Chaincode finished")
@@ -36,24 +71,29 @@ func (t *AssetManagementCC) Init(stub shim.ChaincodeStubInterface, function stri
 func (t *AssetManagementCC) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 
 	logger.Debug("enter Invoke")
+
+	args, proof := common.SplitCallerProof(args)
+	err := assert_invoke_allowed(stub, function, proof)
+	if err != nil {
+		logger.Error(err)
+		return nil, err
+	}
+
 	switch function {
 	case common.AM_REGISTER_CC_ARG:
-		if len(args) != 2 {
-			return nil, errors.New("Expects 2 args: ['chaincode_name', 'chaincode_identifier']")
+		if len(args) != 3 {
+			return nil, errors.New("Expects 3 args: ['chaincode_id', 'service_name', 'caller_token']")
 		}
-		cc_name := args[0]
-		cc_id := args[1]
+		cc_id := args[0]
+		cc_name := args[1]
 
-		// TODO use bool
-		_, err := am.RegisterChaincode(stub, cc_name, cc_id)
-
-		return nil, err
+		err = rm.RegisterChaincode(stub, cc_id, cc_name)
+		if err != nil {
+			return nil, err
+		}
+		return nil, rm.SetCallerToken(stub, cc_id, args[2])
 
 	case common.AM_NEW_REQ_ARG:
-		// expects ["id", "requestor", "requestees,..", "createDate"]
-		if len(args) != 4 {
-			return nil, errors.New("Expects three arguments: ['id', 'requestor', 'requestees,..', 'createDate']")
-		}
 		return t.manage_request(stub, args)
 	case common.AM_NEW_BID_ARG:
 		return t.manage_proposal(stub, args)
@@ -66,6 +106,67 @@ func (t *AssetManagementCC) Invoke(stub shim.ChaincodeStubInterface, function st
 
 	case common.AM_REJECT_ARG:
 		return t.manage_reject(stub, args)
+
+	case common.AM_INVITED_ARG:
+		return t.manage_invite(stub, args)
+
+	case common.AM_WITHDRAWN_ARG, common.AM_EXPIRED_ARG:
+		return t.manage_withdrawal(stub, args)
+
+	case common.AM_REVOKE_ARG:
+		return t.manage_revoke(stub, args, proof)
+
+	case common.AM_GRANT_ARG:
+		return t.manage_grant(stub, args)
+
+	case common.AM_SET_ROLE_ARG:
+		if len(args) != 2 {
+			return nil, errors.New("Expects 2 args ['role', '{\"assetType\":[rights,..],..}']")
+		}
+		var template common.RoleTemplate
+		template.Name = args[0]
+		err := json.Unmarshal([]byte(args[1]), &template.Rights)
+		if err != nil {
+			logger.Error(err)
+			return nil, errors.New("Failed to deserialize rights of role " + args[0])
+		}
+		return nil, pm.SetRoleTemplate(stub, template)
+
+	case common.AM_GRANT_MANDATE_ARG:
+		return t.manage_grant_mandate(stub, args)
+
+	case common.AM_REVOKE_MANDATE_ARG:
+		if len(args) != 1 {
+			return nil, errors.New("Expects 1 arg ['broker']")
+		}
+		cedent, err := get_enrollment_id(stub)
+		if err != nil {
+			return nil, err
+		}
+		return nil, mm.Revoke(stub, cedent, args[0])
+
+	case common.AM_ADD_AUDITOR_ARG:
+		if len(args) != 1 {
+			return nil, errors.New("Expects 1 arg ['userId']")
+		}
+		return nil, pm.AddAuditor(stub, args[0])
+
+	case common.AM_REMOVE_AUDITOR_ARG:
+		if len(args) != 1 {
+			return nil, errors.New("Expects 1 arg ['userId']")
+		}
+		return nil, pm.RemoveAuditor(stub, args[0])
+
+	case common.MIGRATE_ARG:
+		return t.migrate(stub)
+
+	case common.AM_MIGRATE_UA_ARG:
+		migrated, err := um.MigrateAll(stub)
+		if err != nil {
+			return nil, err
+		}
+		logger.Infof("Migrated user asset records of %s", migrated)
+		return nil, nil
 	default:
 		return nil, errors.New("Unrecognized Invoke function: " + function)
 	}
@@ -73,14 +174,15 @@ func (t *AssetManagementCC) Invoke(stub shim.ChaincodeStubInterface, function st
 }
 
 func (t *AssetManagementCC) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	args, proof := common.SplitCallerProof(args)
 	switch function {
 	case common.AM_GET_CC_NAME_ARG:
 		if len(args) != 1 {
-			return nil, errors.New("Expects 2 arguments ['chaincode_id']")
+			return nil, errors.New("Expects 1 argument ['chaincode_id']")
 		}
-		name, err := am.GetChaincodeName(stub, args[0])
+		name, err := rm.GetChaincodeName(stub, args[0])
 		if err != nil {
-			//TODO err
+			return nil, err
 		}
 
 		ccn := common.CCNameResponse{Name: name}
@@ -91,19 +193,46 @@ func (t *AssetManagementCC) Query(stub shim.ChaincodeStubInterface, function str
 		}
 		return r, nil
 
-	case common.AM_GET_U_ASST_ARG:
-		bytes, err := stub.ReadCertAttribute("enrollmentId")
+	case common.AM_VERIFY_CALLER_ARG:
+		if len(args) != 1 {
+			return nil, errors.New("Expects 1 argument ['caller_proof']")
+		}
+		name, err := rm.VerifyCallerToken(stub, args[0])
+		if err != nil {
+			return nil, err
+		}
+
+		response := common.CCNameResponse{Name: name}
+		return response.Encode()
+
+	case common.AM_RESOLVE_CC_ARG:
+		if len(args) != 1 {
+			return nil, errors.New("Expects 1 argument ['service_name']")
+		}
+		id, err := rm.ResolveChaincode(stub, args[0])
+		if err != nil {
+			return nil, err
+		}
+
+		ccn := common.CCNameResponse{Name: id}
+		r, err := ccn.Encode()
 		if err != nil {
 			logger.Error(err)
-			return nil, errors.New("failed to get enrollmentId attribute")
+			return nil, errors.New("failed to encode resolve_chaincode response")
+		}
+		return r, nil
+
+	case common.AM_GET_U_ASST_ARG:
+		enrollmentId, err := get_enrollment_id(stub)
+		if err != nil {
+			return nil, err
 		}
-		enrollmentId := string(bytes)
-		record, err := um.GetUserAssetRecord(stub, enrollmentId)
+		record, err := get_user_view(stub, enrollmentId)
 		if err != nil {
 			return nil, err
 		}
 
-		bytes, err = record.Encode()
+		bytes, err := record.Encode()
 		if err != nil {
 			logger.Error(err)
 			return nil, errors.New("Failed to serialize record response")
@@ -111,9 +240,33 @@ func (t *AssetManagementCC) Query(stub shim.ChaincodeStubInterface, function str
 
 		return bytes, nil
 
+	case common.AM_GET_U_ASST_PG_ARG:
+		if len(args) != 1 {
+			return nil, errors.New("Expects 1 argument, a UserAssetsQuery json document")
+		}
+		var query common.UserAssetsQuery
+		err := query.Decode([]byte(args[0]))
+		if err != nil {
+			logger.Error(err)
+			return nil, errors.New("Failed to deserialize UserAssetsQuery")
+		}
+
+		enrollmentId, err := get_enrollment_id(stub)
+		if err != nil {
+			return nil, err
+		}
+		record, err := get_user_view(stub, enrollmentId)
+		if err != nil {
+			return nil, err
+		}
+
+		response, err := page_user_assets(record, query)
+		if err != nil {
+			return nil, err
+		}
+		return response.Encode()
+
 	case common.AM_GET_AST_RIGHTS_ARG:
-		// TODO only admin access to this method?
-		// TODO cert attribute ?
 		if len(args) != 2 {
 			return nil, errors.New("Expects 2 arguments ['enrollmentId', 'assetId']")
 		}
@@ -121,309 +274,1147 @@ func (t *AssetManagementCC) Query(stub shim.ChaincodeStubInterface, function str
 		enrollmentId := args[0]
 		assetId := args[1]
 
-		exists, err := am.AssetExists(stub, assetId)
+		err := assert_self_or_chaincode(stub, enrollmentId, proof)
 		if err != nil {
-			// TODO
+			return nil, err
 		}
 
-		var rights []common.AssetRight
-		var response common.AssetRightsResponse
-		if exists {
-			rights, err = am.GetUserRights(stub, assetId, enrollmentId)
-			if err != nil {
-				// TODO
-			}
-			// TODO add exists
-			response = common.BuildArr(exists, rights)
+		return t.get_asset_rights(stub, enrollmentId, assetId)
 
-		} else {
-			rights = make([]common.AssetRight, 0)
-			response = common.BuildArr(false, rights)
+	case common.AM_GET_ASTS_RIGHTS_ARG:
+		if len(args) != 2 {
+			return nil, errors.New("Expects 2 arguments ['enrollmentId', 'assetIds,..']")
 		}
 
-		return response.Encode()
+		enrollmentId := args[0]
+		assetIds := strings.Split(args[1], ",")
 
-	default:
-		return nil, errors.New("Unrecognized function : " + function)
-	}
-}
+		err := assert_self_or_chaincode(stub, enrollmentId, proof)
+		if err != nil {
+			return nil, err
+		}
 
-func (t *AssetManagementCC) manage_request(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	requestId := args[0]
-	requestor := args[1]
-	requestees := strings.Split(args[2], ",")
-	createDate, err := strconv.ParseUint(args[3], 10, 64)
-	// TODO parse err
+		return t.get_assets_rights(stub, enrollmentId, assetIds)
 
-	record, err := um.GetUserAssetRecord(stub, requestor)
-	if err != nil {
-		return nil, err
-	}
+	case common.AM_ADMIN_GET_AST_RIGHTS_ARG:
+		if len(args) != 1 {
+			return nil, errors.New("Expects 1 argument ['assetId']")
+		}
+		if !common.IsAdmin(stub) {
+			return nil, errors.New("admin_get_asset_rights requires the admin role")
+		}
 
-	// TODO err
-	err = am.AssignRights(stub, requestId, requestor, []common.AssetRight{common.AOWNER, common.AVIEWER})
+		return t.get_all_asset_rights(stub, args[0])
 
-	record.Submissions[requestId] = common.SubmissionRecord{
-		SubmissionId: requestId,
-		Requestees:   requestees,
-		Created:      createDate,
-		Updated:      createDate,
-	}
+	case common.AM_GET_HISTORY_ARG:
+		if len(args) != 1 {
+			return nil, errors.New("Expects 1 argument ['assetId']")
+		}
+		return t.get_asset_history(stub, args[0])
 
-	_, err = um.SaveUserAssetRecord(stub, requestor, record)
-	if err != nil {
-		logger.Error(err)
-		return nil, errors.New("Failed to save record for id " + requestor)
-	}
+	case common.AM_GET_CHILDREN_ARG:
+		if len(args) != 1 {
+			return nil, errors.New("Expects 1 argument ['assetId']")
+		}
+		return t.get_asset_children(stub, args[0])
 
-	for _, requestee := range requestees {
-		record, err := um.GetUserAssetRecord(stub, requestee)
+	case common.AM_GET_MANDATES_ARG:
+		cedent, err := get_enrollment_id(stub)
+		if err != nil {
+			return nil, err
+		}
+		mandates, err := mm.GetMandates(stub, cedent)
 		if err != nil {
 			return nil, err
 		}
+		response := common.MandatesResponse{Mandates: mandates}
+		return response.Encode()
 
-		record.Requests[requestId] = common.RequestRecord{
-			SubmissionId: requestId,
-			Requestor:    requestor,
-			Created:      createDate,
-			Updated:      createDate,
+	case common.AM_GET_ASSET_INFO_ARG:
+		if len(args) != 1 {
+			return nil, errors.New("Expects 1 argument ['assetId']")
+		}
+		return t.get_asset_info(stub, args[0])
+
+	case common.AM_GET_ROLES_ARG:
+		templates, err := pm.GetRoleTemplates(stub)
+		if err != nil {
+			return nil, err
 		}
+		response := common.RoleTemplatesResponse{Templates: templates}
+		return response.Encode()
 
-		// TODO err
-		err = am.AssignRights(stub, requestId, requestee, []common.AssetRight{common.AVIEWER})
+	case common.AM_ASSET_EXISTS_ARG:
+		if len(args) != 1 {
+			return nil, errors.New("Expects 1 argument ['assetId']")
+		}
 
-		_, err = um.SaveUserAssetRecord(stub, requestee, record)
+		exists, err := am.AssetExists(stub, args[0])
 		if err != nil {
 			logger.Error(err)
-			return nil, errors.New("Failed to save record for id " + requestee)
+			return nil, errors.New("Failed to check existence of asset " + args[0])
 		}
-	}
 
-	return nil, err
-}
+		response := common.AssetExistsResponse{Exists: exists}
+		return response.Encode()
 
-func (t *AssetManagementCC) manage_proposal(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	if len(args) != 4 {
-		return nil, errors.New("Expects 4 args ['proposalId', 'requestId', 'bidder', 'createDate']")
+	default:
+		return nil, errors.New("Unrecognized function : " + function)
 	}
-	proposalId := args[0]
-	requestId := args[1]
-	bidder := args[2]
-	// TODO parse err
-	createDate, err := strconv.ParseUint(args[3], 10, 64)
+}
 
-	record, err := um.GetUserAssetRecord(stub, bidder)
+func (t *AssetManagementCC) get_asset_rights(stub shim.ChaincodeStubInterface, enrollmentId string, assetId string) ([]byte, error) {
+	response, err := asset_rights_response(stub, enrollmentId, assetId)
 	if err != nil {
 		return nil, err
 	}
+	return response.Encode()
+}
 
-	originalReq, ok := record.Requests[requestId]
-	if !ok {
-		return nil, fmt.Errorf("IllegalState user %s has no request asset %s", bidder, requestId)
-	}
-
-	record.Proposals[proposalId] = common.ProposalRecord{
-		SubmissionId: requestId,
-		ProposalId:   proposalId,
-		Created:      createDate,
-		Updated:      createDate,
-		UpdatedBy:    bidder,
-	}
-
-	_, err = um.SaveUserAssetRecord(stub, bidder, record)
-	if err != nil {
-		logger.Error(err)
-		return nil, errors.New("Failed to save record for id " + bidder)
+// The user's rights on each of the assets, answered in a single query
+func (t *AssetManagementCC) get_assets_rights(stub shim.ChaincodeStubInterface, enrollmentId string, assetIds []string) ([]byte, error) {
+	response := common.BulkAssetRightsResponse{Assets: make(map[string]common.AssetRightsResponse)}
+	for _, assetId := range assetIds {
+		rights, err := asset_rights_response(stub, enrollmentId, assetId)
+		if err != nil {
+			return nil, err
+		}
+		response.Assets[assetId] = rights
 	}
+	return response.Encode()
+}
 
-	err = am.AssignRights(stub, proposalId, bidder, []common.AssetRight{common.AOWNER, common.AVIEWER, common.AUPDATER})
+func asset_rights_response(stub shim.ChaincodeStubInterface, enrollmentId string, assetId string) (common.AssetRightsResponse, error) {
+	exists, err := am.AssetExists(stub, assetId)
 	if err != nil {
 		logger.Error(err)
-		return nil, errors.New("Failed to assign rights to id " + bidder)
-	}
-
-	record, err = um.GetUserAssetRecord(stub, originalReq.Requestor)
-	if err != nil {
-		return nil, err
+		return common.AssetRightsResponse{}, errors.New("Failed to check existence of asset " + assetId)
 	}
-
-	record.Proposals[proposalId] = common.ProposalRecord{
-		SubmissionId: requestId,
-		ProposalId:   proposalId,
-		Created:      createDate,
-		Updated:      createDate,
-		UpdatedBy:    bidder,
+	if !exists {
+		return common.BuildArr(false, make([]common.AssetRight, 0)), nil
 	}
 
-	_, err = um.SaveUserAssetRecord(stub, originalReq.Requestor, record)
+	rights, err := user_rights(stub, assetId, enrollmentId)
 	if err != nil {
 		logger.Error(err)
-		return nil, errors.New("Failed to save record for id " + bidder)
+		return common.AssetRightsResponse{}, errors.New("Failed to get rights on asset " + assetId)
 	}
+	return common.BuildArr(true, rights), nil
+}
 
-	err = am.AssignRights(stub, proposalId, originalReq.Requestor, []common.AssetRight{common.AVIEWER, common.AAPPROVAL, common.AUPDATER})
+// Rights of every user on the asset, for auditing
+func (t *AssetManagementCC) get_all_asset_rights(stub shim.ChaincodeStubInterface, assetId string) ([]byte, error) {
+	exists, err := am.AssetExists(stub, assetId)
 	if err != nil {
 		logger.Error(err)
-		return nil, errors.New("Failed to assign rights to id " + bidder)
+		return nil, errors.New("Failed to check existence of asset " + assetId)
 	}
 
-	return nil, nil
-}
-
-func (t *AssetManagementCC) manage_counter(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	if len(args) != 3 {
-		return nil, errors.New("Expects 3 args ['proposalId', 'updater', 'updatedDate']")
+	response := common.AllAssetRightsResponse{
+		Exists:  exists,
+		Rights:  make(map[string][]common.AssetRight),
+		Windows: make(map[string][]common.RightWindow),
+	}
+	if exists {
+		record, err := am.GetAssetRecord(stub, assetId)
+		if err != nil {
+			return nil, err
+		}
+		response.Rights = record.Rights
+		response.Windows = record.Windows
 	}
 
-	proposalId := args[0]
-	updater := args[1]
-	// TODO parse err
-	updated, err := strconv.ParseUint(args[2], 10, 64)
+	return response.Encode()
+}
 
-	record, err := um.GetUserAssetRecord(stub, updater)
+// The audit history of the asset, restricted to its viewers
+func (t *AssetManagementCC) get_asset_history(stub shim.ChaincodeStubInterface, assetId string) ([]byte, error) {
+	caller, err := get_enrollment_id(stub)
 	if err != nil {
 		return nil, err
 	}
 
-	prop, ok := record.Proposals[proposalId]
-	if !ok {
-		return nil, fmt.Errorf("No propsal record %s for user %s", proposalId, updater)
-	}
-
-	prop.Updated = updated
-	prop.UpdatedBy = updater
-
-	// something of a hack to get the second party
-	// TODO review
-	astR, err := am.GetAssetRecord(stub, prop.SubmissionId)
+	rights, err := user_rights(stub, assetId, caller)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to get original submission due to : %s", err)
-	}
-
-	var recipient string = ""
-	for k := range astR.Rights {
-		if k != updater {
-			recipient = k
-			break
-		}
+		return nil, err
 	}
-	if recipient == "" {
-		return nil, errors.New("Illegal state, no second party")
+	if !contains_right(rights, common.AVIEWER) {
+		return nil, fmt.Errorf("User %s may not view the history of asset %s", caller, assetId)
 	}
 
-	_, err = um.SaveUserAssetRecord(stub, updater, record)
+	entries, err := hm.GetHistory(stub, assetId)
 	if err != nil {
-		logger.Error(err)
-		return nil, errors.New("Failed to save record for id " + updater)
+		return nil, err
 	}
 
-	record, err = um.GetUserAssetRecord(stub, recipient)
+	auditor, err := pm.IsAuditor(stub, caller)
 	if err != nil {
 		return nil, err
 	}
-
-	prop.Updated = updated
-	prop.UpdatedBy = updater
-	_, err = um.SaveUserAssetRecord(stub, recipient, record)
-	if err != nil {
-		logger.Error(err)
-		return nil, errors.New("Failed to save record for id " + recipient)
+	if auditor {
+		logger.Infof("Audit read of the history of asset %s by %s in transaction %s", assetId, caller, stub.GetTxID())
 	}
 
-	return nil, nil
+	response := common.AssetHistoryResponse{AssetId: assetId, Entries: entries}
+	return response.Encode()
 }
 
-func (t *AssetManagementCC) manage_accept(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	if len(args) != 2 {
-		return nil, errors.New("Expects 2 args ['proposalId', 'date']")
+// The children of the asset, e.g. the proposals on a request, restricted to
+// those the caller may view
+func (t *AssetManagementCC) get_asset_children(stub shim.ChaincodeStubInterface, parentId string) ([]byte, error) {
+	caller, err := get_enrollment_id(stub)
+	if err != nil {
+		return nil, err
 	}
 
-	proposalId := args[0]
-	// TODO parse err
-	updated, err := strconv.ParseUint(args[1], 10, 64)
-
-	astR, err := am.GetAssetRecord(stub, proposalId)
+	childIds, err := am.GetChildren(stub, parentId)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to get asset record %s due to : %s", proposalId, err)
+		return nil, err
 	}
 
-	for k := range astR.Rights {
-		userR, err := um.GetUserAssetRecord(stub, k)
+	response := common.AssetChildrenResponse{ParentId: parentId, Children: make([]common.AssetInfo, 0)}
+	for _, childId := range childIds {
+		record, err := am.GetAssetRecord(stub, childId)
 		if err != nil {
-			return nil, fmt.Errorf("Failed to get user asset record %s due to : %s", k, err)
+			return nil, err
 		}
 
-		proposal, ok := userR.Proposals[proposalId]
-		if !ok {
-			return nil, fmt.Errorf("No proposal asset %s for user %s", proposalId, k)
+		rights, err := user_rights(stub, childId, caller)
+		if err != nil {
+			return nil, err
 		}
-
-		userR.Accepted[proposalId] = common.AcceptedProposal{
-			SubmissionId: proposal.SubmissionId,
-			ProposalId:   proposalId,
-			Accepted:     updated,
+		if !contains_right(rights, common.AVIEWER) {
+			continue
 		}
 
-		delete(userR.Proposals, proposalId)
-		delete(userR.Submissions, proposal.SubmissionId)
-		delete(userR.Requests, proposal.SubmissionId)
-
-		_, err = um.SaveUserAssetRecord(stub, k, userR)
-		if err != nil {
-			logger.Error(err)
-			return nil, errors.New("Failed to save record for id " + k)
-		}
+		response.Children = append(response.Children, common.AssetInfo{
+			AssetId: childId,
+			Type:    record.Type,
+			Creator: record.Creator,
+			Created: record.Created,
+			Parent:  record.Parent,
+		})
 	}
 
-	return nil, nil
+	return response.Encode()
 }
 
-func (t *AssetManagementCC) manage_reject(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	if len(args) != 2 {
-		return nil, errors.New("Expects 2 args ['proposalId', 'date']")
+// Metadata and parties of the asset, restricted to its viewers
+func (t *AssetManagementCC) get_asset_info(stub shim.ChaincodeStubInterface, assetId string) ([]byte, error) {
+	caller, err := get_enrollment_id(stub)
+	if err != nil {
+		return nil, err
 	}
 
-	proposalId := args[0]
-	// TODO parse err
-	updated, err := strconv.ParseUint(args[1], 10, 64)
-
-	astR, err := am.GetAssetRecord(stub, proposalId)
+	record, err := am.GetAssetRecord(stub, assetId)
+	if err != nil {
+		return nil, err
+	}
+	rights, err := user_rights(stub, assetId, caller)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to get asset record %s due to : %s", proposalId, err)
+		return nil, err
+	}
+	if !contains_right(rights, common.AVIEWER) {
+		return nil, fmt.Errorf("User %s may not view asset %s", caller, assetId)
 	}
 
-	for k := range astR.Rights {
-		userR, err := um.GetUserAssetRecord(stub, k)
-		if err != nil {
-			return nil, fmt.Errorf("Failed to get user asset record %s due to : %s", k, err)
-		}
+	response := common.AssetInfo{
+		AssetId: assetId,
+		Type:    record.Type,
+		Creator: record.Creator,
+		Created: record.Created,
+		Parent:  record.Parent,
+		Parties: record.Parties,
+	}
+	return response.Encode()
+}
 
-		proposal, ok := userR.Proposals[proposalId]
-		if !ok {
-			return nil, fmt.Errorf("No proposal asset %s for user %s", proposalId, k)
-		}
+// Rewrites every stored record at the current schema version, after moving
+// the legacy user asset records to their per-asset layout
+func (t *AssetManagementCC) migrate(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	users, err := um.MigrateAll(stub)
+	if err != nil {
+		return nil, err
+	}
+	assets, err := am.Migrate(stub)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := um.MigrateEntries(stub)
+	if err != nil {
+		return nil, err
+	}
+	history, err := hm.Migrate(stub)
+	if err != nil {
+		return nil, err
+	}
+	mandates, err := mm.Migrate(stub)
+	if err != nil {
+		return nil, err
+	}
+	policies, err := pm.Migrate(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Infof("Migrated %d legacy users, %d assets, %d user asset entries, %d history entries, %d mandates and %d policy records",
+		len(users), assets, entries, history, mandates, policies)
+	return nil, nil
+}
+
+// Each manage_* handler first parses its args and checks every precondition,
+// reading all the records it needs, and only then writes. A failure therefore
+// never leaves some participants' records updated and others not.
+
+func (t *AssetManagementCC) manage_request(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 4 && len(args) != 5 {
+		return nil, errors.New("Expects 4 or 5 args ['id', 'requestor', 'requestees,..', 'createDate', 'broker']")
+	}
+
+	requestId := args[0]
+	requestor := args[1]
+	requestees := strings.Split(args[2], ",")
+	createDate, err := parse_date(args[3])
+	if err != nil {
+		return nil, err
+	}
+	broker := ""
+	if len(args) == 5 {
+		broker = args[4]
+	}
+
+	// Validate
+	if requestId == "" || requestor == "" {
+		return nil, errors.New("Request id and requestor must not be empty")
+	}
+	for _, requestee := range requestees {
+		if requestee == "" {
+			return nil, fmt.Errorf("Empty requestee in %s", args[2])
+		}
+		if requestee == requestor || requestee == broker {
+			return nil, fmt.Errorf("Requestor %s or its broker may not be a requestee", requestor)
+		}
+	}
+	if broker != "" {
+		err = assert_mandate(stub, requestor, broker)
+		if err != nil {
+			return nil, err
+		}
+	}
+	exists, err := am.AssetExists(stub, requestId)
+	if err != nil {
+		logger.Error(err)
+		return nil, errors.New("Failed to check existence of asset " + requestId)
+	}
+	if exists {
+		return nil, fmt.Errorf("Asset %s already exists", requestId)
+	}
+	err = assert_roles_defined(stub, common.ASSET_REQUEST, common.ROLE_CEDENT_UW, common.ROLE_REINSURER_UW, common.ROLE_BROKER)
+	if err != nil {
+		return nil, err
+	}
+
+	// Apply
+	err = am.CreateAsset(stub, requestId, common.ASSET_REQUEST, requestor, createDate, "")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create asset %s due to : %s", requestId, err)
+	}
+
+	submission := common.SubmissionRecord{
+		SubmissionId: requestId,
+		Requestor:    requestor,
+		Broker:       broker,
+		Requestees:   requestees,
+		Created:      createDate,
+		Updated:      createDate,
+	}
+	owners := []partyRole{{requestor, common.ROLE_CEDENT_UW}}
+	parties := []common.AssetParty{{Id: requestor, Role: common.PARTY_REQUESTOR}}
+	if broker != "" {
+		owners = append(owners, partyRole{broker, common.ROLE_BROKER})
+		parties = append(parties, common.AssetParty{Id: broker, Role: common.PARTY_BROKER})
+	}
 
-		userR.Rejected[proposalId] = common.RejectedProposal{
+	for _, p := range owners {
+		err = am.AssignRole(stub, requestId, p.id, p.role)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to assign rights to %s due to : %s", p.id, err)
+		}
+
+		err = um.PutEntry(stub, p.id, common.UA_SUBMISSIONS, requestId, submission)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to save record for %s due to : %s", p.id, err)
+		}
+	}
+
+	err = am.SetParties(stub, requestId, parties)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to set parties of %s due to : %s", requestId, err)
+	}
+
+	for _, requestee := range requestees {
+		err = am.AssignRole(stub, requestId, requestee, common.ROLE_REINSURER_UW)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to assign rights to %s due to : %s", requestee, err)
+		}
+
+		err = um.PutEntry(stub, requestee, common.UA_REQUESTS, requestId, common.RequestRecord{
+			SubmissionId: requestId,
+			Requestor:    requestor,
+			Broker:       broker,
+			Created:      createDate,
+			Updated:      createDate,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to save record for %s due to : %s", requestee, err)
+		}
+	}
+
+	return nil, nil
+}
+
+func (t *AssetManagementCC) manage_proposal(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 4 {
+		return nil, errors.New("Expects 4 args ['proposalId', 'requestId', 'bidder', 'createDate']")
+	}
+	proposalId := args[0]
+	requestId := args[1]
+	bidder := args[2]
+	createDate, err := parse_date(args[3])
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate
+	exists, err := am.AssetExists(stub, proposalId)
+	if err != nil {
+		logger.Error(err)
+		return nil, errors.New("Failed to check existence of asset " + proposalId)
+	}
+	if exists {
+		return nil, fmt.Errorf("Asset %s already exists", proposalId)
+	}
+
+	// The request may have been addressed to the bidder's organization
+	// rather than to the bidder, in which case the organization is party too
+	orgPrincipal := ""
+	var originalReq common.RequestRecord
+	ok, err := um.GetEntry(stub, bidder, common.UA_REQUESTS, requestId, &originalReq)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		org, err := get_org_principal(stub, bidder)
+		if err != nil {
+			return nil, err
+		}
+		if org != "" {
+			ok, err = um.GetEntry(stub, org, common.UA_REQUESTS, requestId, &originalReq)
+			if err != nil {
+				return nil, err
+			}
+			orgPrincipal = org
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("IllegalState user %s has no request asset %s", bidder, requestId)
+	}
+	// The requestor's broker, if any, negotiates the proposal for it
+	reqR, err := am.GetAssetRecord(stub, requestId)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get asset record %s due to : %s", requestId, err)
+	}
+	broker, hasBroker := reqR.GetParty(common.PARTY_BROKER)
+
+	err = assert_roles_defined(stub, common.ASSET_PROPOSAL, common.ROLE_CEDENT_UW, common.ROLE_REINSURER_UW, common.ROLE_REINSURER_ORG, common.ROLE_BROKER)
+	if err != nil {
+		return nil, err
+	}
+
+	// Apply
+	err = am.CreateAsset(stub, proposalId, common.ASSET_PROPOSAL, bidder, createDate, requestId)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create asset %s due to : %s", proposalId, err)
+	}
+
+	proposal := common.ProposalRecord{
+		SubmissionId: requestId,
+		ProposalId:   proposalId,
+		Requestor:    originalReq.Requestor,
+		Broker:       broker.Id,
+		Bidder:       bidder,
+		Created:      createDate,
+		Updated:      createDate,
+		UpdatedBy:    bidder,
+	}
+
+	parties := []partyRole{
+		{bidder, common.ROLE_REINSURER_UW},
+		{originalReq.Requestor, common.ROLE_CEDENT_UW},
+	}
+	if orgPrincipal != "" {
+		parties = append(parties, partyRole{orgPrincipal, common.ROLE_REINSURER_ORG})
+	}
+	if hasBroker {
+		parties = append(parties, partyRole{broker.Id, common.ROLE_BROKER})
+	}
+
+	for _, p := range parties {
+		err = am.AssignRole(stub, proposalId, p.id, p.role)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to assign rights to %s due to : %s", p.id, err)
+		}
+
+		err = um.PutEntry(stub, p.id, common.UA_PROPOSALS, proposalId, proposal)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to save record for %s due to : %s", p.id, err)
+		}
+	}
+
+	proposalParties := []common.AssetParty{
+		{Id: originalReq.Requestor, Role: common.PARTY_REQUESTOR},
+		{Id: bidder, Role: common.PARTY_BIDDER, Org: orgPrincipal},
+	}
+	if hasBroker {
+		proposalParties = append(proposalParties, broker)
+	}
+	err = am.SetParties(stub, proposalId, proposalParties)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to set parties of %s due to : %s", proposalId, err)
+	}
+
+	return nil, nil
+}
+
+func (t *AssetManagementCC) manage_counter(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 3 {
+		return nil, errors.New("Expects 3 args ['proposalId', 'updater', 'updatedDate']")
+	}
+
+	proposalId := args[0]
+	updater := args[1]
+	updated, err := parse_date(args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate
+	parties, proposals, err := t.get_proposal_parties(stub, proposalId)
+	if err != nil {
+		return nil, err
+	}
+
+	updaterOrg, err := get_org_principal(stub, updater)
+	if err != nil {
+		return nil, err
+	}
+	if !common.ContainsString(parties, updater) && (updaterOrg == "" || !common.ContainsString(parties, updaterOrg)) {
+		return nil, fmt.Errorf("User %s is not a party to proposal %s", updater, proposalId)
+	}
+
+	// Apply
+	for _, k := range parties {
+		prop := proposals[k]
+		prop.Updated = updated
+		prop.UpdatedBy = updater
+
+		err = um.PutEntry(stub, k, common.UA_PROPOSALS, proposalId, prop)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to save record for %s due to : %s", k, err)
+		}
+	}
+
+	err = am.RecordAction(stub, proposalId)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to record counter on %s due to : %s", proposalId, err)
+	}
+
+	return nil, nil
+}
+
+func (t *AssetManagementCC) manage_accept(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errors.New("Expects 2 args ['proposalId', 'date']")
+	}
+
+	proposalId := args[0]
+	updated, err := parse_date(args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate
+	parties, proposals, err := t.get_proposal_parties(stub, proposalId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Apply
+	for _, k := range parties {
+		proposal := proposals[k]
+		err = um.PutEntry(stub, k, common.UA_ACCEPTED, proposalId, common.AcceptedProposal{
 			SubmissionId: proposal.SubmissionId,
 			ProposalId:   proposalId,
+			Parties:      parties,
+			Accepted:     updated,
+		})
+		if err == nil {
+			err = um.DeleteEntry(stub, k, common.UA_PROPOSALS, proposalId)
+		}
+		if err == nil {
+			err = um.DeleteEntry(stub, k, common.UA_SUBMISSIONS, proposal.SubmissionId)
+		}
+		if err == nil {
+			err = um.DeleteEntry(stub, k, common.UA_REQUESTS, proposal.SubmissionId)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to save record for %s due to : %s", k, err)
+		}
+	}
+
+	err = am.RecordAction(stub, proposalId)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to record acceptance of %s due to : %s", proposalId, err)
+	}
+
+	return nil, nil
+}
+
+func (t *AssetManagementCC) manage_reject(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errors.New("Expects 2 args ['proposalId', 'date']")
+	}
+
+	proposalId := args[0]
+	updated, err := parse_date(args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate
+	parties, proposals, err := t.get_proposal_parties(stub, proposalId)
+	if err != nil {
+		return nil, err
+	}
+
+	submissionId := proposals[parties[0]].SubmissionId
+	subR, err := am.GetAssetRecord(stub, submissionId)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get asset record %s due to : %s", submissionId, err)
+	}
+	subBroker, _ := subR.GetParty(common.PARTY_BROKER)
+
+	// Apply
+	for _, k := range parties {
+		err = um.PutEntry(stub, k, common.UA_REJECTED, proposalId, common.RejectedProposal{
+			SubmissionId: submissionId,
+			ProposalId:   proposalId,
+			Parties:      parties,
 			Rejected:     updated,
+		})
+		if err == nil {
+			err = um.DeleteEntry(stub, k, common.UA_PROPOSALS, proposalId)
+		}
+		if err == nil {
+			err = um.DeleteEntry(stub, k, common.UA_REQUESTS, submissionId)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to save record for %s due to : %s", k, err)
+		}
+
+		// The rejected party loses its view of the original submission
+		if !subR.UserHasRight(k, common.AOWNER) && k != subBroker.Id {
+			err = am.RemoveUser(stub, submissionId, k)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to revoke rights of %s on %s due to : %s", k, submissionId, err)
+			}
 		}
+	}
 
-		delete(userR.Proposals, proposalId)
-		delete(userR.Requests, proposal.SubmissionId)
+	err = am.RecordAction(stub, proposalId)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to record rejection of %s due to : %s", proposalId, err)
+	}
 
-		_, err = um.SaveUserAssetRecord(stub, k, userR)
+	return nil, nil
+}
+
+// Additional requestees are invited to an open submission. They get the
+// reinsurer role and a request entry, existing requestees are left as is.
+func (t *AssetManagementCC) manage_invite(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 3 {
+		return nil, errors.New("Expects 3 args ['requestId', 'requestees,..', 'date']")
+	}
+
+	requestId := args[0]
+	invitees := strings.Split(args[1], ",")
+	updated, err := parse_date(args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate
+	subR, err := am.GetAssetRecord(stub, requestId)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get asset record %s due to : %s", requestId, err)
+	}
+	if subR.Type != common.ASSET_REQUEST {
+		return nil, fmt.Errorf("Asset %s is not a request", requestId)
+	}
+	requestor, ok := subR.GetParty(common.PARTY_REQUESTOR)
+	if !ok {
+		return nil, fmt.Errorf("Illegal state, no requestor on request %s", requestId)
+	}
+	broker, hasBroker := subR.GetParty(common.PARTY_BROKER)
+	var submission common.SubmissionRecord
+	ok, err = um.GetEntry(stub, requestor.Id, common.UA_SUBMISSIONS, requestId, &submission)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get user asset record %s due to : %s", requestor.Id, err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("No submission asset %s for user %s", requestId, requestor.Id)
+	}
+	for i, invitee := range invitees {
+		if invitee == "" {
+			return nil, fmt.Errorf("Empty requestee in %s", args[1])
+		}
+		if invitee == requestor.Id || (hasBroker && invitee == broker.Id) {
+			return nil, fmt.Errorf("Requestor %s or its broker may not be a requestee", requestor.Id)
+		}
+		if common.ContainsString(submission.Requestees, invitee) || common.ContainsString(invitees[:i], invitee) {
+			return nil, fmt.Errorf("%s is already a requestee of %s", invitee, requestId)
+		}
+	}
+	err = assert_roles_defined(stub, common.ASSET_REQUEST, common.ROLE_REINSURER_UW)
+	if err != nil {
+		return nil, err
+	}
+
+	// Apply
+	for _, invitee := range invitees {
+		err = am.AssignRole(stub, requestId, invitee, common.ROLE_REINSURER_UW)
 		if err != nil {
-			logger.Error(err)
-			return nil, errors.New("Failed to save record for id " + k)
+			return nil, fmt.Errorf("Failed to assign rights to %s due to : %s", invitee, err)
+		}
+
+		err = um.PutEntry(stub, invitee, common.UA_REQUESTS, requestId, common.RequestRecord{
+			SubmissionId: requestId,
+			Requestor:    requestor.Id,
+			Broker:       submission.Broker,
+			Created:      updated,
+			Updated:      updated,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to save record for %s due to : %s", invitee, err)
+		}
+	}
+
+	submission.Requestees = append(submission.Requestees, invitees...)
+	submission.Updated = updated
+	owners := []string{requestor.Id}
+	if hasBroker {
+		owners = append(owners, broker.Id)
+	}
+	for _, k := range owners {
+		err = um.PutEntry(stub, k, common.UA_SUBMISSIONS, requestId, submission)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to save record for %s due to : %s", k, err)
+		}
+	}
+
+	err = am.RecordAction(stub, requestId)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to record invitation to %s due to : %s", requestId, err)
+	}
+
+	return nil, nil
+}
+
+// The submission is withdrawn or expired, its requestees lose their request
+// entries and their rights on it. The requestor and its broker keep the
+// submission.
+func (t *AssetManagementCC) manage_withdrawal(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errors.New("Expects 2 args ['requestId', 'date']")
+	}
+
+	requestId := args[0]
+	updated, err := parse_date(args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate
+	subR, err := am.GetAssetRecord(stub, requestId)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get asset record %s due to : %s", requestId, err)
+	}
+	if subR.Type != common.ASSET_REQUEST {
+		return nil, fmt.Errorf("Asset %s is not a request", requestId)
+	}
+	requestor, ok := subR.GetParty(common.PARTY_REQUESTOR)
+	if !ok {
+		return nil, fmt.Errorf("Illegal state, no requestor on request %s", requestId)
+	}
+	var submission common.SubmissionRecord
+	ok, err = um.GetEntry(stub, requestor.Id, common.UA_SUBMISSIONS, requestId, &submission)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get user asset record %s due to : %s", requestor.Id, err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("No submission asset %s for user %s", requestId, requestor.Id)
+	}
+
+	// Apply
+	for _, requestee := range submission.Requestees {
+		err = um.DeleteEntry(stub, requestee, common.UA_REQUESTS, requestId)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to save record for %s due to : %s", requestee, err)
+		}
+		err = am.RemoveUser(stub, requestId, requestee)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to revoke rights of %s on %s due to : %s", requestee, requestId, err)
+		}
+	}
+
+	submission.Updated = updated
+	owners := []string{requestor.Id}
+	if broker, ok := subR.GetParty(common.PARTY_BROKER); ok {
+		owners = append(owners, broker.Id)
+	}
+	for _, k := range owners {
+		err = um.PutEntry(stub, k, common.UA_SUBMISSIONS, requestId, submission)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to save record for %s due to : %s", k, err)
+		}
+	}
+
+	err = am.RecordAction(stub, requestId)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to record end of %s due to : %s", requestId, err)
+	}
+
+	return nil, nil
+}
+
+// Returns the ids whose records track the proposal, i.e. the requestor, the
+// bidder and the bidder's organization, along with each one's proposal
+// record, failing if any lacks one
+func (t *AssetManagementCC) get_proposal_parties(stub shim.ChaincodeStubInterface, proposalId string) ([]string, map[string]common.ProposalRecord, error) {
+	astR, err := am.GetAssetRecord(stub, proposalId)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to get asset record %s due to : %s", proposalId, err)
+	}
+
+	parties := astR.PartyRecordIds()
+	if len(parties) == 0 {
+		// Proposals made before parties were recorded, every rights holder is a party
+		for k := range astR.Rights {
+			parties = append(parties, k)
+		}
+		sort.Strings(parties)
+	}
+	if len(parties) == 0 {
+		return nil, nil, fmt.Errorf("Illegal state, no parties on proposal %s", proposalId)
+	}
+
+	proposals := make(map[string]common.ProposalRecord)
+	for _, k := range parties {
+		var proposal common.ProposalRecord
+		ok, err := um.GetEntry(stub, k, common.UA_PROPOSALS, proposalId, &proposal)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to get user asset record %s due to : %s", k, err)
+		}
+		if !ok {
+			return nil, nil, fmt.Errorf("No proposal asset %s for user %s", proposalId, k)
+		}
+		proposals[k] = proposal
+	}
+
+	return parties, proposals, nil
+}
+
+// The caller, as cedent, mandates a broker to place business on its behalf
+func (t *AssetManagementCC) manage_grant_mandate(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 && len(args) != 3 {
+		return nil, errors.New("Expects 1 or 3 args ['broker', 'validFrom', 'validTo'], dates as RFC3339")
+	}
+
+	broker := args[0]
+	var from, to uint64
+	var err error
+	if len(args) == 3 {
+		from, err = common.ParseValidityTime(args[1])
+		if err != nil {
+			return nil, err
+		}
+		to, err = common.ParseValidityTime(args[2])
+		if err != nil {
+			return nil, err
+		}
+		if to != 0 && to < from {
+			return nil, errors.New("validTo is before validFrom")
+		}
+	}
+
+	cedent, err := get_enrollment_id(stub)
+	if err != nil {
+		return nil, err
+	}
+	if broker == "" || broker == cedent {
+		return nil, errors.New("A mandate needs a broker other than the cedent")
+	}
+	now, err := common.GetTxTimeMillis(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, mm.Grant(stub, common.Mandate{
+		Cedent:    cedent,
+		Broker:    broker,
+		Granted:   now,
+		ValidFrom: from,
+		ValidTo:   to,
+	})
+}
+
+// Revokes rights depending on the number of args given:
+// ['assetId'] removes the asset entirely, unless it has children,
+// ['assetId', 'userId'] removes the user from the asset,
+// ['assetId', 'userId', 'rights,..'] removes the given rights from the user.
+// Only registered chaincodes may revoke, users go through their own requests
+// and proposals.
+func (t *AssetManagementCC) manage_revoke(stub shim.ChaincodeStubInterface, args []string, proof string) ([]byte, error) {
+	err := assert_registered_chaincode(stub, common.AM_REVOKE_ARG, proof)
+	if err != nil {
+		return nil, err
+	}
+
+	switch len(args) {
+	case 1:
+		err = am.RemoveAsset(stub, args[0])
+	case 2:
+		err = am.RemoveUser(stub, args[0], args[1])
+	case 3:
+		rights, perr := common.ParseAssetRights(args[2])
+		if perr != nil {
+			return nil, perr
+		}
+		err = am.RevokeRights(stub, args[0], args[1], rights)
+	default:
+		return nil, errors.New("Expects 1 to 3 args ['assetId', 'userId', 'rights,..']")
+	}
+
+	if err != nil {
+		logger.Error(err)
+		return nil, fmt.Errorf("Failed to revoke rights on asset %s due to : %s", args[0], err)
+	}
+	return nil, nil
+}
+
+// Lets an asset owner share the asset with another user, limited to the delegable rights.
+// The grant may be bounded by RFC3339 'validFrom' and 'validTo' times, either may be empty.
+func (t *AssetManagementCC) manage_grant(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 3 && len(args) != 5 {
+		return nil, errors.New("Expects 3 or 5 args ['assetId', 'userId', 'rights,..', 'validFrom', 'validTo']")
+	}
+
+	assetId := args[0]
+	userId := args[1]
+	rights, err := common.ParseAssetRights(args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	var validFrom, validTo uint64
+	if len(args) == 5 {
+		validFrom, err = common.ParseValidityTime(args[3])
+		if err != nil {
+			return nil, err
+		}
+		validTo, err = common.ParseValidityTime(args[4])
+		if err != nil {
+			return nil, err
+		}
+		if validTo != 0 && validTo < validFrom {
+			return nil, errors.New("validTo must not be before validFrom")
+		}
+	}
+
+	caller, err := get_enrollment_id(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := common.GetTxTimeMillis(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	astR, err := am.GetAssetRecord(stub, assetId)
+	if err != nil {
+		return nil, err
+	}
+	if !astR.UserHasRightAt(caller, common.AOWNER, now) {
+		return nil, fmt.Errorf("User %s is not the owner of asset %s", caller, assetId)
+	}
+
+	auditor, err := pm.IsAuditor(stub, userId)
+	if err != nil {
+		return nil, err
+	}
+	for _, right := range rights {
+		if auditor && right != common.AVIEWER {
+			return nil, fmt.Errorf("Auditor %s may only be granted view rights", userId)
+		}
+	}
+
+	for _, right := range rights {
+		ok, err := pm.IsDelegable(stub, right)
+		if err != nil {
+			return nil, err
 		}
+		if !ok {
+			return nil, fmt.Errorf("Right %d on asset %s may not be granted by the owner", right, assetId)
+		}
+	}
 
-		// TODO revoke rights on the original submission?
+	err = am.AssignRightsWindow(stub, assetId, userId, rights, validFrom, validTo)
+	if err != nil {
+		logger.Error(err)
+		return nil, errors.New("Failed to assign rights to id " + userId)
+	}
+
+	var shared common.SharedRecord
+	ok, err := um.GetEntry(stub, userId, common.UA_SHARED, assetId, &shared)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		shared = common.SharedRecord{AssetId: assetId, SharedBy: caller}
+	}
+	for _, right := range rights {
+		if !contains_right(shared.Rights, right) {
+			shared.Rights = append(shared.Rights, right)
+		}
+	}
+	shared.Granted = now
+	shared.ValidFrom = validFrom
+	shared.ValidTo = validTo
+
+	err = um.PutEntry(stub, userId, common.UA_SHARED, assetId, shared)
+	if err != nil {
+		logger.Error(err)
+		return nil, errors.New("Failed to save record for id " + userId)
 	}
 
 	return nil, nil
 }
 
+// The rights the user holds on the asset at the transaction time. An auditor
+// holds the view right and nothing else, even on assets it is a party to.
+// Rights are answered by queries, which cannot write state, so reads by
+// auditors are only written to the peer log. Only invokes leave an audit
+// trail in the asset history.
+func user_rights(stub shim.ChaincodeStubInterface, assetId string, enrollmentId string) ([]common.AssetRight, error) {
+	principals, err := get_principals(stub, enrollmentId)
+	if err != nil {
+		return nil, err
+	}
+	now, err := common.GetTxTimeMillis(stub)
+	if err != nil {
+		return nil, err
+	}
+	rights, err := am.GetEffectiveRights(stub, assetId, principals, now)
+	if err != nil {
+		return nil, err
+	}
+	rights, err = restrict_to_mandate(stub, assetId, enrollmentId, rights, now)
+	if err != nil {
+		return nil, err
+	}
+
+	auditor, err := pm.IsAuditor(stub, enrollmentId)
+	if err != nil {
+		return nil, err
+	}
+	if auditor {
+		logger.Infof("Audit access of asset %s by %s in transaction %s", assetId, enrollmentId, stub.GetTxID())
+		return []common.AssetRight{common.AVIEWER}, nil
+	}
+	return rights, nil
+}
+
+// Fails unless the broker holds an active mandate from the cedent
+func assert_mandate(stub shim.ChaincodeStubInterface, cedent string, broker string) error {
+	now, err := common.GetTxTimeMillis(stub)
+	if err != nil {
+		return err
+	}
+	ok, err := mm.HasMandate(stub, cedent, broker, now)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s has no active mandate from %s", broker, cedent)
+	}
+	return nil
+}
+
+// A broker whose mandate has lapsed keeps only its view of the assets it
+// placed for the cedent
+func restrict_to_mandate(stub shim.ChaincodeStubInterface, assetId string, enrollmentId string, rights []common.AssetRight, t uint64) ([]common.AssetRight, error) {
+	record, err := am.GetAssetRecord(stub, assetId)
+	if err != nil {
+		return nil, err
+	}
+	broker, ok := record.GetParty(common.PARTY_BROKER)
+	if !ok || broker.Id != enrollmentId {
+		return rights, nil
+	}
+	requestor, ok := record.GetParty(common.PARTY_REQUESTOR)
+	if !ok {
+		return rights, nil
+	}
+
+	active, err := mm.HasMandate(stub, requestor.Id, broker.Id, t)
+	if err != nil {
+		return nil, err
+	}
+	if active || !contains_right(rights, common.AVIEWER) {
+		return rights, nil
+	}
+	return []common.AssetRight{common.AVIEWER}, nil
+}
+
+// Fails unless every role grants rights on assets of the type
+func assert_roles_defined(stub shim.ChaincodeStubInterface, assetType string, roles ...string) error {
+	for _, role := range roles {
+		_, err := pm.GetRoleRights(stub, role, assetType)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parse_date(arg string) (uint64, error) {
+	date, err := strconv.ParseUint(arg, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid date %s, expected unix milliseconds", arg)
+	}
+	return date, nil
+}
+
+func contains_right(rights []common.AssetRight, right common.AssetRight) bool {
+	for _, e := range rights {
+		if e == right {
+			return true
+		}
+	}
+	return false
+}
+
 // ============================================================================================================================
 // Main
 // ============================================================================================================================
@@ -2,6 +2,9 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"regexp"
+	"sort"
 
 	"github.com/ajmanlove/hyperledger-sandbox/reinsurance_poc/common"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
@@ -9,6 +12,7 @@ import (
 
 // TODO eventually use account ids
 var assetTable = "Assets"
+var childTable = "AssetChildren"
 
 type AssetManager struct {
 }
@@ -25,75 +29,223 @@ func (a *AssetManager) Init(stub shim.ChaincodeStubInterface) error {
 		return errors.New("Failed creating Assets table.")
 	}
 
-	return nil
-}
+	err = stub.CreateTable(childTable, []*shim.ColumnDefinition{
+		{Name: "ParentId", Type: shim.ColumnDefinition_STRING, Key: true},
+		{Name: "ChildId", Type: shim.ColumnDefinition_STRING, Key: true},
+	})
 
-func (a *AssetManager) RegisterChaincode(stub shim.ChaincodeStubInterface, cc_id string, cc_name string) (bool, error) {
-	exists, err := a.ChaincodeExists(stub, cc_id)
 	if err != nil {
-		// TODO err
+		return errors.New("Failed creating AssetChildren table.")
 	}
 
-	if exists {
-		return stub.InsertRow(assetTable, shim.Row{
-			Columns: []*shim.Column{
-				{Value: &shim.Column_String_{String_: cc_id}},
-				{Value: &shim.Column_Bytes{Bytes: []byte(cc_name)}}},
-		})
-
-	} else {
-		return stub.ReplaceRow(assetTable, shim.Row{
-			Columns: []*shim.Column{
-				{Value: &shim.Column_String_{String_: cc_id}},
-				{Value: &shim.Column_Bytes{Bytes: []byte(cc_name)}}},
-		})
-	}
+	return nil
 }
 
-func (a *AssetManager) ChaincodeExists(stub shim.ChaincodeStubInterface, cc_id string) (bool, error) {
-	return a.AssetExists(stub, cc_id)
+func (a *AssetManager) AssetExists(stub shim.ChaincodeStubInterface, assetId string) (bool, error) {
+	r, err := a.get_table_row(stub, assetId)
+	exists := len(r.Columns) > 0
+	logger.Debugf("AssetExists() id: %s, %s", assetId, exists)
+	return exists, err
 }
 
-func (a *AssetManager) GetChaincodeName(stub shim.ChaincodeStubInterface, cc_id string) (string, error) {
-	exists, err := a.ChaincodeExists(stub, cc_id)
+// Creates the record of a new asset along with its metadata, linking it to
+// its parent asset if it has one
+func (a *AssetManager) CreateAsset(stub shim.ChaincodeStubInterface, assetId string, assetType string, creator string, created uint64, parent string) error {
+	exists, err := a.AssetExists(stub, assetId)
 	if err != nil {
-		//TODO
+		logger.Error(err)
+		return errors.New("Failed to check existence of asset " + assetId)
 	}
 	if exists {
-		r, err := a.get_table_row(stub, cc_id)
-		if err != nil {
-			// TODO
-		}
-		return string(r.Columns[1].GetBytes()), nil
-	} else {
-		return "", errors.New("No such chaincode registered with identifier " + cc_id)
+		return errors.New("Asset already exists : " + assetId)
+	}
+
+	var record common.AssetRecord
+	record.Init()
+	record.Type = assetType
+	record.Creator = creator
+	record.Created = created
+	record.Parent = parent
+
+	_, err = a.save_record(stub, assetId, record)
+	if err != nil {
+		return err
+	}
+
+	if parent == "" {
+		return nil
+	}
+	_, err = stub.InsertRow(childTable, shim.Row{
+		Columns: []*shim.Column{
+			{Value: &shim.Column_String_{String_: parent}},
+			{Value: &shim.Column_String_{String_: assetId}}},
+	})
+	if err != nil {
+		logger.Error(err)
+		return errors.New("Failed to link asset " + assetId + " to its parent " + parent)
 	}
+	return nil
 }
 
-func (a *AssetManager) AssetExists(stub shim.ChaincodeStubInterface, assetId string) (bool, error) {
-	r, err := a.get_table_row(stub, assetId)
-	exists := len(r.Columns) > 0
-	logger.Debugf("AssetExists() id: %s, %s", assetId, exists)
-	return exists, err
+// The ids of the assets created under the parent, sorted
+func (a *AssetManager) GetChildren(stub shim.ChaincodeStubInterface, parentId string) ([]string, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: parentId}}
+	columns = append(columns, col1)
+
+	rows, err := stub.GetRows(childTable, columns)
+	if err != nil {
+		logger.Error(err)
+		return nil, errors.New("Failed to get children of asset " + parentId)
+	}
+
+	children := make([]string, 0)
+	for row := range rows {
+		children = append(children, row.Columns[1].GetString_())
+	}
+	sort.Strings(children)
+	return children, nil
 }
 
 func (a *AssetManager) AssignRights(stub shim.ChaincodeStubInterface, assetId string, userId string, rights []common.AssetRight) error {
 	record, err := a.get_or_create_record(stub, assetId)
 	if err != nil {
-		// TODO
+		return err
 	}
 	record.AssignUserRights(userId, rights)
 	_, err = a.save_record(stub, assetId, record)
+	return err
+}
+
+// Assigns the rights the role template grants on assets of this asset's type
+func (a *AssetManager) AssignRole(stub shim.ChaincodeStubInterface, assetId string, userId string, role string) error {
+	record, err := a.GetAssetRecord(stub, assetId)
 	if err != nil {
-		// TODO
+		return err
 	}
-	return nil
+	rights, err := pm.GetRoleRights(stub, role, record.Type)
+	if err != nil {
+		return err
+	}
+	rightsCopy := make([]common.AssetRight, len(rights))
+	copy(rightsCopy, rights)
+	record.AssignUserRights(userId, rightsCopy)
+	_, err = a.save_record(stub, assetId, record)
+	return err
+}
+
+// Assigns rights that are only valid between from and to (unix millis, 0 is open)
+func (a *AssetManager) AssignRightsWindow(stub shim.ChaincodeStubInterface, assetId string, userId string, rights []common.AssetRight, from uint64, to uint64) error {
+	record, err := a.get_or_create_record(stub, assetId)
+	if err != nil {
+		return err
+	}
+	record.AssignUserRightsWindow(userId, rights, from, to)
+	_, err = a.save_record(stub, assetId, record)
+	return err
+}
+
+func (a *AssetManager) SetParties(stub shim.ChaincodeStubInterface, assetId string, parties []common.AssetParty) error {
+	record, err := a.GetAssetRecord(stub, assetId)
+	if err != nil {
+		return err
+	}
+	record.Parties = parties
+	_, err = a.save_record(stub, assetId, record)
+	return err
+}
+
+func (a *AssetManager) RevokeRights(stub shim.ChaincodeStubInterface, assetId string, userId string, rights []common.AssetRight) error {
+	record, err := a.GetAssetRecord(stub, assetId)
+	if err != nil {
+		return err
+	}
+	for _, right := range rights {
+		record.RevokeRight(userId, right)
+	}
+	_, err = a.save_record(stub, assetId, record)
+	return err
+}
+
+func (a *AssetManager) RemoveUser(stub shim.ChaincodeStubInterface, assetId string, userId string) error {
+	record, err := a.GetAssetRecord(stub, assetId)
+	if err != nil {
+		return err
+	}
+	record.RemoveUser(userId)
+	_, err = a.save_record(stub, assetId, record)
+	return err
+}
+
+// Removes the asset along with its link to its parent and the entries it
+// left in its users' asset views. An asset with children is not removed, the
+// children would be left pointing at it.
+func (a *AssetManager) RemoveAsset(stub shim.ChaincodeStubInterface, assetId string) error {
+	exists, err := a.AssetExists(stub, assetId)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New("No such asset record : " + assetId)
+	}
+
+	children, err := a.GetChildren(stub, assetId)
+	if err != nil {
+		return err
+	}
+	if len(children) > 0 {
+		return fmt.Errorf("Asset %s still has %d children, remove them first", assetId, len(children))
+	}
+
+	before, err := a.GetAssetRecord(stub, assetId)
+	if err != nil {
+		return err
+	}
+
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: assetId}}
+	columns = append(columns, col1)
+	err = stub.DeleteRow(assetTable, columns)
+	if err != nil {
+		return err
+	}
+
+	if before.Parent != "" {
+		err = stub.DeleteRow(childTable, []shim.Column{
+			{Value: &shim.Column_String_{String_: before.Parent}},
+			{Value: &shim.Column_String_{String_: assetId}},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = um.DeleteAssetEntries(stub, assetId)
+	if err != nil {
+		return err
+	}
+
+	var removed common.AssetRecord
+	removed.Init()
+	return hm.Append(stub, assetId, before, removed)
+}
+
+// Logs an action on the asset that leaves its rights unchanged
+func (a *AssetManager) RecordAction(stub shim.ChaincodeStubInterface, assetId string) error {
+	record, err := a.GetAssetRecord(stub, assetId)
+	if err != nil {
+		return err
+	}
+	return hm.Append(stub, assetId, record, record)
 }
 
 func (a *AssetManager) GetAssetRecord(stub shim.ChaincodeStubInterface, assetId string) (common.AssetRecord, error) {
 	var r common.AssetRecord
 	existing, err := a.get_table_row(stub, assetId)
-	// TODO use err
+	if err != nil {
+		logger.Error(err)
+		return r, errors.New("Failed to get asset record: " + assetId)
+	}
 	if len(existing.Columns) > 0 {
 		err = r.Decode(existing.Columns[1].GetBytes())
 		if err != nil {
@@ -115,13 +267,103 @@ func (a *AssetManager) GetUserRights(stub shim.ChaincodeStubInterface, assetId s
 	return record.Rights[userId], nil
 }
 
+// Union of the rights valid at t held by any of the principals, i.e. a user and its organization
+func (a *AssetManager) GetEffectiveRights(stub shim.ChaincodeStubInterface, assetId string, principals []string, t uint64) ([]common.AssetRight, error) {
+	record, err := a.GetAssetRecord(stub, assetId)
+	if err != nil {
+		return make([]common.AssetRight, 0), err
+	}
+
+	rights := make([]common.AssetRight, 0)
+	for _, p := range principals {
+		for _, right := range record.UserRightsAt(p, t) {
+			if !contains_right(rights, right) {
+				rights = append(rights, right)
+			}
+		}
+	}
+	return rights, nil
+}
+
+// Rewrites every asset record at the current schema version, returning the
+// number rewritten. Chaincode registrations still kept in the Assets table
+// are moved to the service registry, any other row that is not a record
+// fails the migration.
+func (a *AssetManager) Migrate(stub shim.ChaincodeStubInterface) (int, error) {
+	rows, err := stub.GetRows(assetTable, []shim.Column{})
+	if err != nil {
+		logger.Error(err)
+		return 0, errors.New("Failed to get asset records")
+	}
+
+	assets := make([]shim.Row, 0)
+	for row := range rows {
+		assets = append(assets, row)
+	}
+
+	for _, row := range assets {
+		assetId := row.Columns[0].GetString_()
+		bytes := row.Columns[1].GetBytes()
+
+		if is_legacy_registration(bytes) {
+			// Registrations hold the plain chaincode name rather than a record
+			logger.Infof("Moving chaincode registration %s to the service registry, register it again with its caller token", assetId)
+			err = rm.RegisterChaincode(stub, assetId, string(bytes))
+			if err != nil {
+				return 0, err
+			}
+			err = stub.DeleteRow(assetTable, []shim.Column{
+				{Value: &shim.Column_String_{String_: assetId}},
+			})
+			if err != nil {
+				logger.Error(err)
+				return 0, errors.New("Failed to delete chaincode registration " + assetId)
+			}
+			continue
+		}
+
+		var record common.AssetRecord
+		err = record.Decode(bytes)
+		if err != nil {
+			logger.Error(err)
+			return 0, errors.New("Failed to deserialize asset record " + assetId)
+		}
+
+		recordBytes, err := record.Encode()
+		if err != nil {
+			logger.Error(err)
+			return 0, errors.New("Failed to serialize record")
+		}
+		_, err = stub.ReplaceRow(assetTable, shim.Row{
+			Columns: []*shim.Column{
+				{Value: &shim.Column_String_{String_: assetId}},
+				{Value: &shim.Column_Bytes{Bytes: recordBytes}}},
+		})
+		if err != nil {
+			logger.Error(err)
+			return 0, errors.New("Failed to rewrite asset record " + assetId)
+		}
+	}
+	return len(assets), nil
+}
+
+// Chaincode registrations were once kept in the Assets table as the bare
+// chaincode name, which unlike a record is never JSON
+var legacyRegistrationName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+func is_legacy_registration(bytes []byte) bool {
+	return legacyRegistrationName.Match(bytes)
+}
+
 func (a *AssetManager) get_or_create_record(stub shim.ChaincodeStubInterface, assetId string) (common.AssetRecord, error) {
 	var r common.AssetRecord
 
 	existing, err := a.get_table_row(stub, assetId)
-	// TODO use err
+	if err != nil {
+		logger.Error(err)
+		return r, errors.New("Failed to get asset record: " + assetId)
+	}
 	if len(existing.Columns) > 0 {
-
 		err = r.Decode(existing.Columns[1].GetBytes())
 		if err != nil {
 			logger.Error(err)
@@ -153,21 +395,32 @@ func (a *AssetManager) save_record(stub shim.ChaincodeStubInterface, assetId str
 
 	exists, err := a.AssetExists(stub, assetId)
 	if err != nil {
-		// TODO
+		logger.Error(err)
+		return false, errors.New("Failed to check existence of asset " + assetId)
 	}
 
+	before, err := a.get_or_create_record(stub, assetId)
+	if err != nil {
+		return false, err
+	}
+
+	var ok bool
 	if exists {
-		return stub.ReplaceRow(assetTable, shim.Row{
+		ok, err = stub.ReplaceRow(assetTable, shim.Row{
 			Columns: []*shim.Column{
 				{Value: &shim.Column_String_{String_: assetId}},
 				{Value: &shim.Column_Bytes{Bytes: []byte(recordBytes)}}},
 		})
 	} else {
-		return stub.InsertRow(assetTable, shim.Row{
+		ok, err = stub.InsertRow(assetTable, shim.Row{
 			Columns: []*shim.Column{
 				{Value: &shim.Column_String_{String_: assetId}},
 				{Value: &shim.Column_Bytes{Bytes: []byte(recordBytes)}}},
 		})
 	}
+	if err != nil || !ok {
+		return ok, err
+	}
 
+	return true, hm.Append(stub, assetId, before, record)
 }
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ajmanlove/hyperledger-sandbox/reinsurance_poc/common"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func get_enrollment_id(stub shim.ChaincodeStubInterface) (string, error) {
+	bytes, err := stub.ReadCertAttribute("enrollmentId")
+	if err != nil {
+		logger.Error(err)
+		return "", errors.New("failed to get enrollmentId attribute")
+	}
+	return string(bytes), nil
+}
+
+// Returns the organization principal of the user if the transaction cert
+// belongs to that user and carries an affiliation, otherwise ""
+func get_org_principal(stub shim.ChaincodeStubInterface, enrollmentId string) (string, error) {
+	caller, err := get_enrollment_id(stub)
+	if err != nil {
+		return "", err
+	}
+	if caller != enrollmentId {
+		return "", nil
+	}
+
+	bytes, err := stub.ReadCertAttribute(common.AFFILIATION_ATTR)
+	if err != nil || len(bytes) == 0 {
+		logger.Debugf("No affiliation attribute for %s", enrollmentId)
+		return "", nil
+	}
+	return common.OrgPrincipal(string(bytes)), nil
+}
+
+// The principals whose rights apply to the user
+func get_principals(stub shim.ChaincodeStubInterface, enrollmentId string) ([]string, error) {
+	principals := []string{enrollmentId}
+	org, err := get_org_principal(stub, enrollmentId)
+	if err != nil {
+		return nil, err
+	}
+	if org != "" {
+		principals = append(principals, org)
+	}
+	return principals, nil
+}
+
+// Registered chaincodes prove their calls with the caller token they append
+// as the last arg, checked against the digest kept in the registry. The proof
+// only holds while the token stays secret: it is an init arg of the calling
+// chaincode, so it lies in that chaincode's deploy transaction and state and
+// in every call it makes. Anyone who can read those, i.e. a peer of a network
+// without confidentiality, or another registered chaincode the token is sent
+// to, can present it as that chaincode. The transaction itself cannot prove
+// the caller, as a nested call carries the user's transaction and not the
+// calling chaincode's.
+func is_registered_chaincode_call(stub shim.ChaincodeStubInterface, proof string) (bool, error) {
+	if proof == "" {
+		return false, nil
+	}
+	cc_id, err := rm.CallerChaincode(stub, proof)
+	if err != nil {
+		return false, err
+	}
+	return cc_id != "", nil
+}
+
+// Invoke functions that change asset state on behalf of the other chaincodes
+var chaincodeOnlyInvokes = map[string]bool{
+	common.AM_NEW_REQ_ARG:   true,
+	common.AM_NEW_BID_ARG:   true,
+	common.AM_NEW_CNTR_ARG:  true,
+	common.AM_ACCEPT_ARG:    true,
+	common.AM_REJECT_ARG:    true,
+	common.AM_WITHDRAWN_ARG: true,
+	common.AM_EXPIRED_ARG:   true,
+	common.AM_INVITED_ARG:   true,
+	common.AM_REVOKE_ARG:    true,
+}
+
+// Invoke functions reserved to users with the admin role
+var adminOnlyInvokes = map[string]bool{
+	common.AM_REGISTER_CC_ARG:    true,
+	common.AM_MIGRATE_UA_ARG:     true,
+	common.MIGRATE_ARG:           true,
+	common.AM_SET_ROLE_ARG:       true,
+	common.AM_ADD_AUDITOR_ARG:    true,
+	common.AM_REMOVE_AUDITOR_ARG: true,
+}
+
+// Verifies the caller may use the given invoke function, returning a
+// *common.AuthorizationError if it may not
+func assert_invoke_allowed(stub shim.ChaincodeStubInterface, function string, proof string) error {
+	if chaincodeOnlyInvokes[function] {
+		return assert_registered_chaincode(stub, function, proof)
+	}
+	if adminOnlyInvokes[function] && !common.IsAdmin(stub) {
+		return &common.AuthorizationError{Function: function, Caller: describe_caller(stub), Reason: "requires the admin role"}
+	}
+	return nil
+}
+
+func assert_registered_chaincode(stub shim.ChaincodeStubInterface, function string, proof string) error {
+	registered, err := is_registered_chaincode_call(stub, proof)
+	if err != nil {
+		return err
+	}
+	if !registered {
+		return &common.AuthorizationError{Function: function, Caller: describe_caller(stub), Reason: "not a registered chaincode"}
+	}
+	return nil
+}
+
+// Best effort description of the caller for error messages
+func describe_caller(stub shim.ChaincodeStubInterface) string {
+	caller, err := get_enrollment_id(stub)
+	if err != nil {
+		return "unknown user"
+	}
+	return caller
+}
+
+// Allows the user asking about itself, or any registered chaincode asking on behalf of a user
+func assert_self_or_chaincode(stub shim.ChaincodeStubInterface, enrollmentId string, proof string) error {
+	registered, err := is_registered_chaincode_call(stub, proof)
+	if err != nil {
+		return err
+	}
+	if registered {
+		return nil
+	}
+
+	caller, err := get_enrollment_id(stub)
+	if err != nil {
+		return err
+	}
+	if caller != enrollmentId {
+		return fmt.Errorf("User %s may not query the rights of %s", caller, enrollmentId)
+	}
+	return nil
+}
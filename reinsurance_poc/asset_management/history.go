@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/ajmanlove/hyperledger-sandbox/reinsurance_poc/common"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var historyTable = "AssetHistory"
+var historySeqKeyPrefix = "HistorySeq_"
+
+// Keeps an append-only audit log of the changes made to each asset
+type HistoryManager struct{}
+
+// TODO check exists
+func (h *HistoryManager) Init(stub shim.ChaincodeStubInterface) error {
+	err := stub.CreateTable(historyTable, []*shim.ColumnDefinition{
+		{Name: "AssetId", Type: shim.ColumnDefinition_STRING, Key: true},
+		{Name: "Seq", Type: shim.ColumnDefinition_UINT64, Key: true},
+		{Name: "Entry", Type: shim.ColumnDefinition_BYTES, Key: false},
+	})
+
+	if err != nil {
+		return errors.New("Failed creating AssetHistory table.")
+	}
+
+	return nil
+}
+
+// Appends an entry for an action on the asset given its state before and
+// after. The action is the name of the invoked asset management function and
+// the actor the transaction's user. Entries are never rewritten, a
+// transaction changing the asset several times appends consecutive entries
+// sharing its TxId.
+func (h *HistoryManager) Append(stub shim.ChaincodeStubInterface, assetId string, before common.AssetRecord, after common.AssetRecord) error {
+	now, err := common.GetTxTimeMillis(stub)
+	if err != nil {
+		return err
+	}
+
+	seq, err := h.next_seq(stub, assetId)
+	if err != nil {
+		return err
+	}
+
+	return h.put_entry(stub, common.AssetHistoryEntry{
+		AssetId:       assetId,
+		Seq:           seq,
+		Actor:         describe_caller(stub),
+		Action:        current_action(stub),
+		Before:        before.Rights,
+		After:         after.Rights,
+		BeforeWindows: before.Windows,
+		AfterWindows:  after.Windows,
+		BeforeParties: before.Parties,
+		AfterParties:  after.Parties,
+		Timestamp:     now,
+		TxId:          stub.GetTxID(),
+	}, false)
+}
+
+// Inserts the entry, or with replace rewrites it in place, which only the
+// migration does
+func (h *HistoryManager) put_entry(stub shim.ChaincodeStubInterface, entry common.AssetHistoryEntry, replace bool) error {
+	bytes, err := entry.Encode()
+	if err != nil {
+		logger.Error(err)
+		return errors.New("Failed to serialize history entry")
+	}
+
+	row := shim.Row{
+		Columns: []*shim.Column{
+			{Value: &shim.Column_String_{String_: entry.AssetId}},
+			{Value: &shim.Column_Uint64{Uint64: entry.Seq}},
+			{Value: &shim.Column_Bytes{Bytes: bytes}}},
+	}
+	var ok bool
+	if replace {
+		ok, err = stub.ReplaceRow(historyTable, row)
+	} else {
+		ok, err = stub.InsertRow(historyTable, row)
+	}
+	if err != nil {
+		logger.Error(err)
+		return errors.New("Failed to save history entry for asset " + entry.AssetId)
+	}
+	if !ok {
+		return fmt.Errorf("Failed to save history entry %d of asset %s", entry.Seq, entry.AssetId)
+	}
+	return nil
+}
+
+// All entries of the asset, oldest first
+func (h *HistoryManager) GetHistory(stub shim.ChaincodeStubInterface, assetId string) ([]common.AssetHistoryEntry, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: assetId}}
+	columns = append(columns, col1)
+
+	rows, err := stub.GetRows(historyTable, columns)
+	if err != nil {
+		logger.Error(err)
+		return nil, errors.New("Failed to get history of asset " + assetId)
+	}
+
+	entries := make([]common.AssetHistoryEntry, 0)
+	for row := range rows {
+		var entry common.AssetHistoryEntry
+		err = entry.Decode(row.Columns[2].GetBytes())
+		if err != nil {
+			logger.Error(err)
+			return nil, errors.New("Failed to deserialize history entry of asset " + assetId)
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Sort(common.BySeq(entries))
+	return entries, nil
+}
+
+// Rewrites every history entry at the current schema version, leaving its
+// content unchanged, and returns the number of entries rewritten
+func (h *HistoryManager) Migrate(stub shim.ChaincodeStubInterface) (int, error) {
+	rows, err := stub.GetRows(historyTable, []shim.Column{})
+	if err != nil {
+		logger.Error(err)
+		return 0, errors.New("Failed to get history entries")
+	}
+
+	entries := make([]common.AssetHistoryEntry, 0)
+	for row := range rows {
+		var entry common.AssetHistoryEntry
+		err = entry.Decode(row.Columns[2].GetBytes())
+		if err != nil {
+			logger.Error(err)
+			return 0, errors.New("Failed to deserialize history entry of asset " + row.Columns[0].GetString_())
+		}
+		entries = append(entries, entry)
+	}
+
+	for _, entry := range entries {
+		err = h.put_entry(stub, entry, true)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(entries), nil
+}
+
+func (h *HistoryManager) current_seq(stub shim.ChaincodeStubInterface, assetId string) (uint64, error) {
+	bytes, err := stub.GetState(historySeqKeyPrefix + assetId)
+	if err != nil {
+		logger.Error(err)
+		return 0, errors.New("Failed to get history sequence of asset " + assetId)
+	}
+	if bytes == nil {
+		return 0, nil
+	}
+	seq, err := strconv.ParseUint(string(bytes), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Corrupt history sequence of asset %s : %s", assetId, err)
+	}
+	return seq, nil
+}
+
+func (h *HistoryManager) next_seq(stub shim.ChaincodeStubInterface, assetId string) (uint64, error) {
+	seq, err := h.current_seq(stub, assetId)
+	if err != nil {
+		return 0, err
+	}
+	seq++
+
+	err = stub.PutState(historySeqKeyPrefix+assetId, []byte(strconv.FormatUint(seq, 10)))
+	if err != nil {
+		logger.Error(err)
+		return 0, errors.New("Failed to put history sequence of asset " + assetId)
+	}
+	return seq, nil
+}
+
+// The asset management function being invoked, args[0] of the transaction input
+func current_action(stub shim.ChaincodeStubInterface) string {
+	args := stub.GetArgs()
+	if len(args) == 0 {
+		return "unknown"
+	}
+	return string(args[0])
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ajmanlove/hyperledger-sandbox/reinsurance_poc/common"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var mandateTable = "Mandates"
+
+// Keeps the mandates cedents grant to brokers to act on their behalf
+type MandateManager struct {
+}
+
+func (m *MandateManager) Init(stub shim.ChaincodeStubInterface) error {
+	err := stub.CreateTable(mandateTable, []*shim.ColumnDefinition{
+		{Name: "CedentId", Type: shim.ColumnDefinition_STRING, Key: true},
+		{Name: "BrokerId", Type: shim.ColumnDefinition_STRING, Key: true},
+		{Name: "Record", Type: shim.ColumnDefinition_BYTES, Key: false},
+	})
+
+	if err != nil {
+		return errors.New("Failed creating Mandates table.")
+	}
+
+	return nil
+}
+
+// Grants the mandate, replacing any earlier one between the same parties
+func (m *MandateManager) Grant(stub shim.ChaincodeStubInterface, mandate common.Mandate) error {
+	bytes, err := mandate.Encode()
+	if err != nil {
+		logger.Error(err)
+		return errors.New("Failed to serialize mandate")
+	}
+
+	_, exists, err := m.Get(stub, mandate.Cedent, mandate.Broker)
+	if err != nil {
+		return err
+	}
+
+	row := shim.Row{
+		Columns: []*shim.Column{
+			{Value: &shim.Column_String_{String_: mandate.Cedent}},
+			{Value: &shim.Column_String_{String_: mandate.Broker}},
+			{Value: &shim.Column_Bytes{Bytes: bytes}}},
+	}
+	if exists {
+		_, err = stub.ReplaceRow(mandateTable, row)
+	} else {
+		_, err = stub.InsertRow(mandateTable, row)
+	}
+	if err != nil {
+		logger.Error(err)
+		return fmt.Errorf("Failed to save mandate of %s for %s", mandate.Cedent, mandate.Broker)
+	}
+	return nil
+}
+
+func (m *MandateManager) Revoke(stub shim.ChaincodeStubInterface, cedent string, broker string) error {
+	_, exists, err := m.Get(stub, cedent, broker)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("%s has no mandate from %s", broker, cedent)
+	}
+
+	err = stub.DeleteRow(mandateTable, []shim.Column{
+		{Value: &shim.Column_String_{String_: cedent}},
+		{Value: &shim.Column_String_{String_: broker}},
+	})
+	if err != nil {
+		logger.Error(err)
+		return fmt.Errorf("Failed to revoke mandate of %s for %s", cedent, broker)
+	}
+	return nil
+}
+
+func (m *MandateManager) Get(stub shim.ChaincodeStubInterface, cedent string, broker string) (common.Mandate, bool, error) {
+	var mandate common.Mandate
+	row, err := stub.GetRow(mandateTable, []shim.Column{
+		{Value: &shim.Column_String_{String_: cedent}},
+		{Value: &shim.Column_String_{String_: broker}},
+	})
+	if err != nil {
+		logger.Error(err)
+		return mandate, false, fmt.Errorf("Failed to get mandate of %s for %s", cedent, broker)
+	}
+	if len(row.Columns) == 0 {
+		return mandate, false, nil
+	}
+
+	err = mandate.Decode(row.Columns[2].GetBytes())
+	if err != nil {
+		logger.Error(err)
+		return mandate, false, fmt.Errorf("Failed to deserialize mandate of %s for %s", cedent, broker)
+	}
+	return mandate, true, nil
+}
+
+// True if the broker holds a mandate from the cedent that is active at t
+func (m *MandateManager) HasMandate(stub shim.ChaincodeStubInterface, cedent string, broker string, t uint64) (bool, error) {
+	mandate, exists, err := m.Get(stub, cedent, broker)
+	if err != nil {
+		return false, err
+	}
+	return exists && mandate.ActiveAt(t), nil
+}
+
+// All mandates granted by the cedent
+func (m *MandateManager) GetMandates(stub shim.ChaincodeStubInterface, cedent string) ([]common.Mandate, error) {
+	rows, err := stub.GetRows(mandateTable, []shim.Column{
+		{Value: &shim.Column_String_{String_: cedent}},
+	})
+	if err != nil {
+		logger.Error(err)
+		return nil, errors.New("Failed to get mandates of " + cedent)
+	}
+
+	mandates := make([]common.Mandate, 0)
+	for row := range rows {
+		var mandate common.Mandate
+		err = mandate.Decode(row.Columns[2].GetBytes())
+		if err != nil {
+			logger.Error(err)
+			return nil, errors.New("Failed to deserialize mandate of " + cedent)
+		}
+		mandates = append(mandates, mandate)
+	}
+	return mandates, nil
+}
+
+// Rewrites every mandate at the current schema version, returning the number rewritten
+func (m *MandateManager) Migrate(stub shim.ChaincodeStubInterface) (int, error) {
+	rows, err := stub.GetRows(mandateTable, []shim.Column{})
+	if err != nil {
+		logger.Error(err)
+		return 0, errors.New("Failed to get mandates")
+	}
+
+	mandates := make([]common.Mandate, 0)
+	for row := range rows {
+		var mandate common.Mandate
+		err = mandate.Decode(row.Columns[2].GetBytes())
+		if err != nil {
+			logger.Error(err)
+			return 0, errors.New("Failed to deserialize mandate of " + row.Columns[0].GetString_())
+		}
+		mandates = append(mandates, mandate)
+	}
+
+	for _, mandate := range mandates {
+		err = m.Grant(stub, mandate)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(mandates), nil
+}
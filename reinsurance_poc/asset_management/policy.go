@@ -0,0 +1,324 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/ajmanlove/hyperledger-sandbox/reinsurance_poc/common"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var delegableRightsKey = "DelegableRights"
+
+// Rights an asset owner may grant to other users when no configuration is given
+var defaultDelegableRights = []common.AssetRight{common.AVIEWER, common.AUPDATER}
+
+var roleTemplatesKey = "RoleTemplates"
+var auditorsKey = "Auditors"
+
+// Role templates in effect until an admin configures them. Auditors hold no
+// role, their view of every asset comes from the auditor designation.
+var defaultRoleTemplates = map[string]map[string][]common.AssetRight{
+	common.ROLE_CEDENT_UW: {
+		common.ASSET_REQUEST:  {common.AOWNER, common.AVIEWER},
+		common.ASSET_PROPOSAL: {common.AVIEWER, common.AAPPROVAL, common.AUPDATER},
+		common.ASSET_CONTRACT: {common.AVIEWER},
+	},
+	common.ROLE_REINSURER_UW: {
+		common.ASSET_REQUEST:  {common.AVIEWER},
+		common.ASSET_PROPOSAL: {common.AOWNER, common.AVIEWER, common.AUPDATER},
+		common.ASSET_CONTRACT: {common.AVIEWER},
+	},
+	common.ROLE_REINSURER_ORG: {
+		common.ASSET_REQUEST:  {common.AVIEWER},
+		common.ASSET_PROPOSAL: {common.AVIEWER, common.AUPDATER},
+		common.ASSET_CONTRACT: {common.AVIEWER},
+	},
+	common.ROLE_BROKER: {
+		common.ASSET_REQUEST:  {common.AVIEWER, common.AUPDATER},
+		common.ASSET_PROPOSAL: {common.AVIEWER, common.AAPPROVAL, common.AUPDATER},
+		common.ASSET_CONTRACT: {common.AVIEWER},
+	},
+}
+
+// Holds the access policy configuration of asset management
+type PolicyManager struct{}
+
+func (p *PolicyManager) Init(stub shim.ChaincodeStubInterface, delegable []common.AssetRight, auditors []string) error {
+	if delegable == nil {
+		delegable = defaultDelegableRights
+	}
+	err := p.SetDelegableRights(stub, delegable)
+	if err != nil {
+		return err
+	}
+	if auditors == nil {
+		return nil
+	}
+	return p.set_auditors(stub, auditors)
+}
+
+func (p *PolicyManager) SetDelegableRights(stub shim.ChaincodeStubInterface, rights []common.AssetRight) error {
+	record := common.DelegableRightsRecord{Rights: rights}
+	bytes, err := record.Encode()
+	if err != nil {
+		logger.Error(err)
+		return errors.New("Failed to serialize delegable rights")
+	}
+	return stub.PutState(delegableRightsKey, bytes)
+}
+
+func (p *PolicyManager) GetDelegableRights(stub shim.ChaincodeStubInterface) ([]common.AssetRight, error) {
+	bytes, err := stub.GetState(delegableRightsKey)
+	if err != nil {
+		logger.Error(err)
+		return nil, errors.New("Failed to get delegable rights")
+	}
+	if bytes == nil {
+		return defaultDelegableRights, nil
+	}
+
+	var record common.DelegableRightsRecord
+	err = record.Decode(bytes)
+	if err != nil {
+		logger.Error(err)
+		return nil, errors.New("Failed to deserialize delegable rights")
+	}
+	return record.Rights, nil
+}
+
+func (p *PolicyManager) IsDelegable(stub shim.ChaincodeStubInterface, right common.AssetRight) (bool, error) {
+	rights, err := p.GetDelegableRights(stub)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range rights {
+		if e == right {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Replaces the rights granted by the role, adding the role if it is new
+func (p *PolicyManager) SetRoleTemplate(stub shim.ChaincodeStubInterface, template common.RoleTemplate) error {
+	for assetType, rights := range template.Rights {
+		for _, right := range rights {
+			if !common.IsValidAssetRight(right) {
+				return fmt.Errorf("Unknown asset right %d for %s assets of role %s", right, assetType, template.Name)
+			}
+		}
+	}
+
+	templates, err := p.get_role_templates(stub)
+	if err != nil {
+		return err
+	}
+	templates[template.Name] = template.Rights
+	return p.set_role_templates(stub, templates)
+}
+
+// All role templates, sorted by name
+func (p *PolicyManager) GetRoleTemplates(stub shim.ChaincodeStubInterface) ([]common.RoleTemplate, error) {
+	templates, err := p.get_role_templates(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0)
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := make([]common.RoleTemplate, 0)
+	for _, name := range names {
+		result = append(result, common.RoleTemplate{Name: name, Rights: templates[name]})
+	}
+	return result, nil
+}
+
+// The rights the role grants on assets of the given type
+func (p *PolicyManager) GetRoleRights(stub shim.ChaincodeStubInterface, role string, assetType string) ([]common.AssetRight, error) {
+	templates, err := p.get_role_templates(stub)
+	if err != nil {
+		return nil, err
+	}
+	rights, ok := templates[role]
+	if !ok {
+		return nil, fmt.Errorf("No such role template %s", role)
+	}
+	if len(rights[assetType]) == 0 {
+		return nil, fmt.Errorf("Role %s grants no rights on %s assets", role, assetType)
+	}
+	return rights[assetType], nil
+}
+
+func (p *PolicyManager) get_role_templates(stub shim.ChaincodeStubInterface) (map[string]map[string][]common.AssetRight, error) {
+	bytes, err := stub.GetState(roleTemplatesKey)
+	if err != nil {
+		logger.Error(err)
+		return nil, errors.New("Failed to get role templates")
+	}
+
+	if bytes == nil {
+		templates := make(map[string]map[string][]common.AssetRight)
+		for name, rights := range defaultRoleTemplates {
+			templates[name] = rights
+		}
+		return templates, nil
+	}
+
+	var record common.RoleTemplatesRecord
+	err = record.Decode(bytes)
+	if err != nil {
+		logger.Error(err)
+		return nil, errors.New("Failed to deserialize role templates")
+	}
+	return record.Templates, nil
+}
+
+func (p *PolicyManager) set_role_templates(stub shim.ChaincodeStubInterface, templates map[string]map[string][]common.AssetRight) error {
+	record := common.RoleTemplatesRecord{Templates: templates}
+	bytes, err := record.Encode()
+	if err != nil {
+		logger.Error(err)
+		return errors.New("Failed to serialize role templates")
+	}
+	return stub.PutState(roleTemplatesKey, bytes)
+}
+
+// Auditors may view every asset and hold no other right on any, see user_rights
+func (p *PolicyManager) IsAuditor(stub shim.ChaincodeStubInterface, userId string) (bool, error) {
+	auditors, err := p.GetAuditors(stub)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range auditors {
+		if e == userId {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (p *PolicyManager) AddAuditor(stub shim.ChaincodeStubInterface, userId string) error {
+	auditors, err := p.GetAuditors(stub)
+	if err != nil {
+		return err
+	}
+	for _, e := range auditors {
+		if e == userId {
+			return nil
+		}
+	}
+	return p.set_auditors(stub, append(auditors, userId))
+}
+
+func (p *PolicyManager) RemoveAuditor(stub shim.ChaincodeStubInterface, userId string) error {
+	auditors, err := p.GetAuditors(stub)
+	if err != nil {
+		return err
+	}
+	remaining := make([]string, 0)
+	for _, e := range auditors {
+		if e != userId {
+			remaining = append(remaining, e)
+		}
+	}
+	if len(remaining) == len(auditors) {
+		return errors.New("No such auditor " + userId)
+	}
+	return p.set_auditors(stub, remaining)
+}
+
+func (p *PolicyManager) GetAuditors(stub shim.ChaincodeStubInterface) ([]string, error) {
+	bytes, err := stub.GetState(auditorsKey)
+	if err != nil {
+		logger.Error(err)
+		return nil, errors.New("Failed to get auditors")
+	}
+	if bytes == nil {
+		return make([]string, 0), nil
+	}
+
+	var record common.AuditorsRecord
+	err = record.Decode(bytes)
+	if err != nil {
+		logger.Error(err)
+		return nil, errors.New("Failed to deserialize auditors")
+	}
+	return record.Auditors, nil
+}
+
+func (p *PolicyManager) set_auditors(stub shim.ChaincodeStubInterface, auditors []string) error {
+	sort.Strings(auditors)
+	record := common.AuditorsRecord{Auditors: auditors}
+	bytes, err := record.Encode()
+	if err != nil {
+		logger.Error(err)
+		return errors.New("Failed to serialize auditors")
+	}
+	return stub.PutState(auditorsKey, bytes)
+}
+
+// Rewrites the configured delegable rights, role templates and auditors at
+// their current schema versions and returns the number of records rewritten.
+// Configuration never set keeps using the defaults.
+func (p *PolicyManager) Migrate(stub shim.ChaincodeStubInterface) (int, error) {
+	migrated := 0
+
+	bytes, err := stub.GetState(delegableRightsKey)
+	if err != nil {
+		logger.Error(err)
+		return 0, errors.New("Failed to get delegable rights")
+	}
+	if bytes != nil {
+		rights, err := p.GetDelegableRights(stub)
+		if err != nil {
+			return 0, err
+		}
+		err = p.SetDelegableRights(stub, rights)
+		if err != nil {
+			return 0, err
+		}
+		migrated++
+	}
+
+	bytes, err = stub.GetState(roleTemplatesKey)
+	if err != nil {
+		logger.Error(err)
+		return 0, errors.New("Failed to get role templates")
+	}
+	if bytes != nil {
+		templates, err := p.get_role_templates(stub)
+		if err != nil {
+			return 0, err
+		}
+		err = p.set_role_templates(stub, templates)
+		if err != nil {
+			return 0, err
+		}
+		migrated++
+	}
+
+	bytes, err = stub.GetState(auditorsKey)
+	if err != nil {
+		logger.Error(err)
+		return 0, errors.New("Failed to get auditors")
+	}
+	if bytes != nil {
+		auditors, err := p.GetAuditors(stub)
+		if err != nil {
+			return 0, err
+		}
+		err = p.set_auditors(stub, auditors)
+		if err != nil {
+			return 0, err
+		}
+		migrated++
+	}
+
+	return migrated, nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ajmanlove/hyperledger-sandbox/reinsurance_poc/common"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var chaincodeTable = "Chaincodes"
+var serviceTable = "Services"
+var callerTokenTable = "CallerTokens"
+
+// Maps the logical names of the poc chaincodes, i.e. reinsurance_request, to
+// the names they are deployed under. Registered chaincodes may change asset
+// state, and chaincodes resolve each other through the registry so that one
+// can be redeployed without redeploying the others. Each registration also
+// holds the digest of the caller token the chaincode appends to its calls,
+// which is how asset management and the registered chaincodes tell which of
+// them made a call.
+type RegistryManager struct {
+}
+
+func (r *RegistryManager) Init(stub shim.ChaincodeStubInterface) error {
+	err := stub.CreateTable(chaincodeTable, []*shim.ColumnDefinition{
+		{Name: "ChaincodeId", Type: shim.ColumnDefinition_STRING, Key: true},
+		{Name: "Name", Type: shim.ColumnDefinition_BYTES, Key: false},
+	})
+
+	if err != nil {
+		return errors.New("Failed creating Chaincodes table.")
+	}
+
+	err = stub.CreateTable(serviceTable, []*shim.ColumnDefinition{
+		{Name: "Name", Type: shim.ColumnDefinition_STRING, Key: true},
+		{Name: "ChaincodeId", Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+
+	if err != nil {
+		return errors.New("Failed creating Services table.")
+	}
+
+	err = stub.CreateTable(callerTokenTable, []*shim.ColumnDefinition{
+		{Name: "TokenHash", Type: shim.ColumnDefinition_STRING, Key: true},
+		{Name: "ChaincodeId", Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+
+	if err != nil {
+		return errors.New("Failed creating CallerTokens table.")
+	}
+
+	return nil
+}
+
+// Registers the deployed chaincode under the logical name, replacing any
+// previous registration of either. The chaincode cannot prove its calls
+// until SetCallerToken gives it a token.
+func (r *RegistryManager) RegisterChaincode(stub shim.ChaincodeStubInterface, cc_id string, cc_name string) error {
+	if cc_id == "" || cc_name == "" {
+		return errors.New("Chaincode id and name must not be empty")
+	}
+
+	previous, err := r.get_service_row(stub, cc_name)
+	if err != nil {
+		logger.Error(err)
+		return errors.New("Failed to check registration of service " + cc_name)
+	}
+	if len(previous.Columns) > 0 {
+		previousId := previous.Columns[1].GetString_()
+		if previousId != cc_id {
+			err = stub.DeleteRow(chaincodeTable, []shim.Column{
+				{Value: &shim.Column_String_{String_: previousId}},
+			})
+			if err != nil {
+				logger.Error(err)
+				return errors.New("Failed to unregister chaincode " + previousId)
+			}
+			err = r.remove_caller_tokens(stub, previousId)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	current, err := stub.GetRow(chaincodeTable, []shim.Column{
+		{Value: &shim.Column_String_{String_: cc_id}},
+	})
+	if err != nil {
+		logger.Error(err)
+		return errors.New("Failed to check registration of chaincode " + cc_id)
+	}
+	if len(current.Columns) > 0 {
+		currentName := string(current.Columns[1].GetBytes())
+		if currentName != cc_name {
+			err = stub.DeleteRow(serviceTable, []shim.Column{
+				{Value: &shim.Column_String_{String_: currentName}},
+			})
+			if err != nil {
+				logger.Error(err)
+				return errors.New("Failed to unregister service " + currentName)
+			}
+		}
+	}
+
+	err = r.put_row(stub, chaincodeTable, len(current.Columns) > 0, shim.Row{
+		Columns: []*shim.Column{
+			{Value: &shim.Column_String_{String_: cc_id}},
+			{Value: &shim.Column_Bytes{Bytes: []byte(cc_name)}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	return r.put_row(stub, serviceTable, len(previous.Columns) > 0, shim.Row{
+		Columns: []*shim.Column{
+			{Value: &shim.Column_String_{String_: cc_name}},
+			{Value: &shim.Column_String_{String_: cc_id}}},
+	})
+}
+
+func (r *RegistryManager) ChaincodeExists(stub shim.ChaincodeStubInterface, cc_id string) (bool, error) {
+	row, err := r.get_chaincode_row(stub, cc_id)
+	return len(row.Columns) > 0, err
+}
+
+// The logical name of the deployed chaincode
+func (r *RegistryManager) GetChaincodeName(stub shim.ChaincodeStubInterface, cc_id string) (string, error) {
+	row, err := r.get_chaincode_row(stub, cc_id)
+	if err != nil {
+		logger.Error(err)
+		return "", errors.New("Failed to get chaincode registration " + cc_id)
+	}
+	if len(row.Columns) > 0 {
+		return string(row.Columns[1].GetBytes()), nil
+	} else {
+		return "", errors.New("No such chaincode registered with identifier " + cc_id)
+	}
+}
+
+// The deployed name of the chaincode registered under the logical name
+func (r *RegistryManager) ResolveChaincode(stub shim.ChaincodeStubInterface, cc_name string) (string, error) {
+	row, err := r.get_service_row(stub, cc_name)
+	if err != nil {
+		logger.Error(err)
+		return "", errors.New("Failed to get service registration " + cc_name)
+	}
+	if len(row.Columns) == 0 {
+		return "", fmt.Errorf("No chaincode registered as %s", cc_name)
+	}
+	return row.Columns[1].GetString_(), nil
+}
+
+// Replaces the caller token of the registered chaincode, the token it was
+// given at deploy time
+func (r *RegistryManager) SetCallerToken(stub shim.ChaincodeStubInterface, cc_id string, token string) error {
+	if token == "" {
+		return errors.New("Caller token must not be empty")
+	}
+	exists, err := r.ChaincodeExists(stub, cc_id)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New("No such chaincode registered with identifier " + cc_id)
+	}
+
+	err = r.remove_caller_tokens(stub, cc_id)
+	if err != nil {
+		return err
+	}
+	_, err = stub.InsertRow(callerTokenTable, shim.Row{
+		Columns: []*shim.Column{
+			{Value: &shim.Column_String_{String_: common.HashCallerToken(token)}},
+			{Value: &shim.Column_String_{String_: cc_id}}},
+	})
+	if err != nil {
+		logger.Error(err)
+		return errors.New("Failed to save caller token of chaincode " + cc_id)
+	}
+	return nil
+}
+
+// The deployed name of the registered chaincode the caller token belongs
+// to, "" if no registered chaincode was given the token
+func (r *RegistryManager) CallerChaincode(stub shim.ChaincodeStubInterface, token string) (string, error) {
+	row, err := stub.GetRow(callerTokenTable, []shim.Column{
+		{Value: &shim.Column_String_{String_: common.HashCallerToken(token)}},
+	})
+	if err != nil {
+		logger.Error(err)
+		return "", errors.New("Failed to look up caller token")
+	}
+	if len(row.Columns) == 0 {
+		return "", nil
+	}
+	return row.Columns[1].GetString_(), nil
+}
+
+// The logical name of the registered chaincode the caller token belongs to.
+// Fails for tokens no registered chaincode was given.
+func (r *RegistryManager) VerifyCallerToken(stub shim.ChaincodeStubInterface, token string) (string, error) {
+	cc_id, err := r.CallerChaincode(stub, token)
+	if err != nil {
+		return "", err
+	}
+	if cc_id == "" {
+		return "", errors.New("Unknown caller token")
+	}
+	return r.GetChaincodeName(stub, cc_id)
+}
+
+func (r *RegistryManager) remove_caller_tokens(stub shim.ChaincodeStubInterface, cc_id string) error {
+	rows, err := stub.GetRows(callerTokenTable, []shim.Column{})
+	if err != nil {
+		logger.Error(err)
+		return errors.New("Failed to get caller tokens")
+	}
+
+	hashes := make([]string, 0)
+	for row := range rows {
+		if row.Columns[1].GetString_() == cc_id {
+			hashes = append(hashes, row.Columns[0].GetString_())
+		}
+	}
+
+	for _, hash := range hashes {
+		err = stub.DeleteRow(callerTokenTable, []shim.Column{
+			{Value: &shim.Column_String_{String_: hash}},
+		})
+		if err != nil {
+			logger.Error(err)
+			return errors.New("Failed to remove caller token of chaincode " + cc_id)
+		}
+	}
+	return nil
+}
+
+// Registrations once kept in the Assets table are not consulted, the migrate
+// invoke moves them here
+func (r *RegistryManager) get_chaincode_row(stub shim.ChaincodeStubInterface, cc_id string) (shim.Row, error) {
+	return stub.GetRow(chaincodeTable, []shim.Column{
+		{Value: &shim.Column_String_{String_: cc_id}},
+	})
+}
+
+func (r *RegistryManager) get_service_row(stub shim.ChaincodeStubInterface, cc_name string) (shim.Row, error) {
+	return stub.GetRow(serviceTable, []shim.Column{
+		{Value: &shim.Column_String_{String_: cc_name}},
+	})
+}
+
+func (r *RegistryManager) put_row(stub shim.ChaincodeStubInterface, table string, exists bool, row shim.Row) error {
+	var err error
+	if exists {
+		_, err = stub.ReplaceRow(table, row)
+	} else {
+		_, err = stub.InsertRow(table, row)
+	}
+	if err != nil {
+		logger.Error(err)
+		return errors.New("Failed to save registration in " + table)
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ajmanlove/hyperledger-sandbox/reinsurance_poc/common"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var defaultPageSize = 20
+var maxPageSize = 100
+
+// The user's asset record including the assets addressed to the user's organization
+func get_user_view(stub shim.ChaincodeStubInterface, enrollmentId string) (common.UserAssetsRecord, error) {
+	record, err := um.GetUserAssetRecord(stub, enrollmentId)
+	if err != nil {
+		return record, err
+	}
+
+	org, err := get_org_principal(stub, enrollmentId)
+	if err != nil {
+		return record, err
+	}
+	if org != "" {
+		orgRecord, err := um.GetUserAssetRecord(stub, org)
+		if err != nil {
+			return record, err
+		}
+		record.Merge(orgRecord)
+	}
+	return record, nil
+}
+
+// Selects, filters, sorts and pages a single category of the record
+func page_user_assets(record common.UserAssetsRecord, query common.UserAssetsQuery) (common.UserAssetsPageResponse, error) {
+	response := common.UserAssetsPageResponse{Category: query.Category, Entries: make([]common.UserAssetEntry, 0)}
+
+	pageSize := query.PageSize
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+
+	entries, err := category_entries(record, query.Category)
+	if err != nil {
+		return response, err
+	}
+
+	filtered := make([]common.UserAssetEntry, 0)
+	for _, e := range entries {
+		if query.UpdatedFrom != 0 && e.Updated < query.UpdatedFrom {
+			continue
+		}
+		if query.UpdatedTo != 0 && e.Updated > query.UpdatedTo {
+			continue
+		}
+		if query.Counterparty != "" && !common.ContainsString(e.Counterparties, query.Counterparty) {
+			continue
+		}
+		filtered = append(filtered, e)
+	}
+	sort.Sort(byUpdatedDesc(filtered))
+
+	start := 0
+	if query.ContinuationToken != "" {
+		updated, id, err := parse_continuation_token(query.ContinuationToken)
+		if err != nil {
+			return response, err
+		}
+		// The token is the sort key of the last entry returned, resume right after it
+		for start < len(filtered) && !entry_after(filtered[start], updated, id) {
+			start++
+		}
+	}
+
+	end := start + pageSize
+	if end >= len(filtered) {
+		end = len(filtered)
+	} else {
+		last := filtered[end-1]
+		response.ContinuationToken = fmt.Sprintf("%d|%s", last.Updated, last.AssetId)
+	}
+
+	response.Entries = filtered[start:end]
+	return response, nil
+}
+
+func category_entries(record common.UserAssetsRecord, category string) ([]common.UserAssetEntry, error) {
+	entries := make([]common.UserAssetEntry, 0)
+	switch category {
+	case common.UA_SUBMISSIONS:
+		for k, v := range record.Submissions {
+			entries = append(entries, common.UserAssetEntry{AssetId: k, Counterparties: submission_counterparties(v), Updated: v.Updated, Record: v})
+		}
+	case common.UA_REQUESTS:
+		for k, v := range record.Requests {
+			entries = append(entries, common.UserAssetEntry{AssetId: k, Counterparties: non_empty(v.Requestor, v.Broker), Updated: v.Updated, Record: v})
+		}
+	case common.UA_PROPOSALS:
+		for k, v := range record.Proposals {
+			entries = append(entries, common.UserAssetEntry{AssetId: k, Counterparties: non_empty(v.Requestor, v.Broker, v.Bidder), Updated: v.Updated, Record: v})
+		}
+	case common.UA_ACCEPTED:
+		for k, v := range record.Accepted {
+			entries = append(entries, common.UserAssetEntry{AssetId: k, Counterparties: v.Parties, Updated: v.Accepted, Record: v})
+		}
+	case common.UA_REJECTED:
+		for k, v := range record.Rejected {
+			entries = append(entries, common.UserAssetEntry{AssetId: k, Counterparties: v.Parties, Updated: v.Rejected, Record: v})
+		}
+	case common.UA_CONTRACTS:
+		for k, v := range record.Contracts {
+			entries = append(entries, common.UserAssetEntry{AssetId: k, Counterparties: v.Requestees, Updated: v.Updated, Record: v})
+		}
+	case common.UA_SHARED:
+		for k, v := range record.Shared {
+			entries = append(entries, common.UserAssetEntry{AssetId: k, Counterparties: []string{v.SharedBy}, Updated: v.Granted, Record: v})
+		}
+	default:
+		return nil, errors.New("Unrecognized user assets category : " + category)
+	}
+	return entries, nil
+}
+
+// A broker's submission has its requestor as counterparty too
+func submission_counterparties(v common.SubmissionRecord) []string {
+	return append(non_empty(v.Requestor, v.Broker), v.Requestees...)
+}
+
+func non_empty(values ...string) []string {
+	result := make([]string, 0)
+	for _, e := range values {
+		if e != "" {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+func parse_continuation_token(token string) (uint64, string, error) {
+	parts := strings.SplitN(token, "|", 2)
+	if len(parts) != 2 {
+		return 0, "", errors.New("Malformed continuation token : " + token)
+	}
+	updated, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, "", errors.New("Malformed continuation token : " + token)
+	}
+	return updated, parts[1], nil
+}
+
+// True if e sorts after the entry with the given key
+func entry_after(e common.UserAssetEntry, updated uint64, id string) bool {
+	if e.Updated != updated {
+		return e.Updated < updated
+	}
+	return e.AssetId > id
+}
+
+// Newest first, ties broken by asset id
+type byUpdatedDesc []common.UserAssetEntry
+
+func (s byUpdatedDesc) Len() int      { return len(s) }
+func (s byUpdatedDesc) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byUpdatedDesc) Less(i, j int) bool {
+	if s[i].Updated != s[j].Updated {
+		return s[i].Updated > s[j].Updated
+	}
+	return s[i].AssetId < s[j].AssetId
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 
 	"github.com/ajmanlove/hyperledger-sandbox/reinsurance_poc/common"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
@@ -10,12 +12,27 @@ import (
 // TODO eventually use account ids
 type UserManager struct{}
 
+// Holds one row per (user, category, asset)
+var userAssetEntriesTable = "UserAssetEntries"
+
+// Legacy layout holding a single UserAssetsRecord blob per user. Rows are
+// moved to userAssetEntriesTable on the user's next write or by migrate_user_assets.
 var userAssetsTable = "UserAssets"
 
 // TODO check exists
 func (a *UserManager) Init(stub shim.ChaincodeStubInterface) error {
-	// Create enrollment table
-	err := stub.CreateTable(userAssetsTable, []*shim.ColumnDefinition{
+	err := stub.CreateTable(userAssetEntriesTable, []*shim.ColumnDefinition{
+		{Name: "UserId", Type: shim.ColumnDefinition_STRING, Key: true},
+		{Name: "Category", Type: shim.ColumnDefinition_STRING, Key: true},
+		{Name: "AssetId", Type: shim.ColumnDefinition_STRING, Key: true},
+		{Name: "Record", Type: shim.ColumnDefinition_BYTES, Key: false},
+	})
+
+	if err != nil {
+		return errors.New("Failed creating UserAssetEntries table.")
+	}
+
+	err = stub.CreateTable(userAssetsTable, []*shim.ColumnDefinition{
 		{Name: "UserId", Type: shim.ColumnDefinition_STRING, Key: true},
 		{Name: "Records", Type: shim.ColumnDefinition_BYTES, Key: false},
 	})
@@ -27,59 +44,284 @@ func (a *UserManager) Init(stub shim.ChaincodeStubInterface) error {
 	return nil
 }
 
-func (a *UserManager) UserRecordExists(stub shim.ChaincodeStubInterface, userId string) (bool, error) {
-	existing, err := a.get_record(stub, userId)
-	exists := len(existing.Columns) > 0
+// Assembles the full UserAssetsRecord view of the user from its entries
+func (a *UserManager) GetUserAssetRecord(stub shim.ChaincodeStubInterface, userId string) (common.UserAssetsRecord, error) {
+	record, err := a.get_legacy_record(stub, userId)
+	if err != nil {
+		return record, err
+	}
+
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: userId}}
+	columns = append(columns, col1)
 
-	logger.Debugf("UserRecordExists() id: %s, %s", userId, exists)
-	return exists, err
-}
+	rows, err := stub.GetRows(userAssetEntriesTable, columns)
+	if err != nil {
+		logger.Error(err)
+		return record, errors.New("Failed to get user asset entries for " + userId)
+	}
 
-func (a *UserManager) GetUserAssetRecord(stub shim.ChaincodeStubInterface, userId string) (common.UserAssetsRecord, error) {
-	return a.get_or_create_record(stub, userId)
+	for row := range rows {
+		category := row.Columns[1].GetString_()
+		assetId := row.Columns[2].GetString_()
+		err = put_view_entry(&record, category, assetId, row.Columns[3].GetBytes())
+		if err != nil {
+			logger.Error(err)
+			return record, fmt.Errorf("Failed to deserialize user asset entry %s/%s/%s", userId, category, assetId)
+		}
+	}
+
+	return record, nil
 }
 
-func (a *UserManager) SaveUserAssetRecord(stub shim.ChaincodeStubInterface, userId string, record common.UserAssetsRecord) (bool, error) {
-	logger.Debug("save_record()")
-	logger.Debugf("record is [%s]", record)
+// Decodes the user's entry into v, returning false if there is none
+func (a *UserManager) GetEntry(stub shim.ChaincodeStubInterface, userId string, category string, assetId string, v interface{}) (bool, error) {
+	row, err := a.get_entry_row(stub, userId, category, assetId)
+	if err != nil {
+		logger.Error(err)
+		return false, fmt.Errorf("Failed to get user asset entry %s/%s/%s", userId, category, assetId)
+	}
+
+	var bytes []byte
+	if len(row.Columns) > 0 {
+		bytes = row.Columns[3].GetBytes()
+	} else {
+		bytes, err = a.get_legacy_entry(stub, userId, category, assetId)
+		if err != nil || bytes == nil {
+			return false, err
+		}
+	}
 
-	recordBytes, err := record.Encode()
+	err = json.Unmarshal(bytes, v)
 	if err != nil {
 		logger.Error(err)
-		return false, errors.New("Failed to serialize record")
+		return false, fmt.Errorf("Failed to deserialize user asset entry %s/%s/%s", userId, category, assetId)
+	}
+	common.UpgradeUserAssetEntry(v)
+	return true, nil
+}
+
+// Inserts or replaces the user's entry
+func (a *UserManager) PutEntry(stub shim.ChaincodeStubInterface, userId string, category string, assetId string, v interface{}) error {
+	err := a.ensure_migrated(stub, userId)
+	if err != nil {
+		return err
 	}
 
-	exists, err := a.UserRecordExists(stub, userId)
+	bytes, err := common.EncodeUserAssetEntry(v)
 	if err != nil {
 		logger.Error(err)
-		return false, errors.New("Failed to get record for enrollment id : " + userId)
+		return errors.New("Failed to serialize user asset entry")
 	}
 
-	logger.Debugf("marshalled is [%s]", recordBytes)
+	row := shim.Row{
+		Columns: []*shim.Column{
+			{Value: &shim.Column_String_{String_: userId}},
+			{Value: &shim.Column_String_{String_: category}},
+			{Value: &shim.Column_String_{String_: assetId}},
+			{Value: &shim.Column_Bytes{Bytes: bytes}}},
+	}
 
-	if !exists {
-		return stub.InsertRow(userAssetsTable, shim.Row{
-			Columns: []*shim.Column{
-				{Value: &shim.Column_String_{String_: userId}},
-				{Value: &shim.Column_Bytes{Bytes: []byte(recordBytes)}}},
-		})
+	existing, err := a.get_entry_row(stub, userId, category, assetId)
+	if err != nil {
+		logger.Error(err)
+		return fmt.Errorf("Failed to get user asset entry %s/%s/%s", userId, category, assetId)
+	}
 
+	if len(existing.Columns) > 0 {
+		_, err = stub.ReplaceRow(userAssetEntriesTable, row)
 	} else {
-		return stub.ReplaceRow(userAssetsTable, shim.Row{
+		_, err = stub.InsertRow(userAssetEntriesTable, row)
+	}
+	if err != nil {
+		logger.Error(err)
+		return fmt.Errorf("Failed to save user asset entry %s/%s/%s", userId, category, assetId)
+	}
+	return nil
+}
+
+func (a *UserManager) DeleteEntry(stub shim.ChaincodeStubInterface, userId string, category string, assetId string) error {
+	err := a.ensure_migrated(stub, userId)
+	if err != nil {
+		return err
+	}
+
+	err = stub.DeleteRow(userAssetEntriesTable, entry_key(userId, category, assetId))
+	if err != nil {
+		logger.Error(err)
+		return fmt.Errorf("Failed to delete user asset entry %s/%s/%s", userId, category, assetId)
+	}
+	return nil
+}
+
+// Deletes every user's entries for the asset, returning the number deleted.
+// Users still holding the asset in a legacy blob are migrated first.
+func (a *UserManager) DeleteAssetEntries(stub shim.ChaincodeStubInterface, assetId string) (int, error) {
+	legacy, err := stub.GetRows(userAssetsTable, []shim.Column{})
+	if err != nil {
+		logger.Error(err)
+		return 0, errors.New("Failed to get legacy user asset records")
+	}
+
+	legacyUsers := make([]string, 0)
+	for row := range legacy {
+		var record common.UserAssetsRecord
+		err = record.Decode(row.Columns[1].GetBytes())
+		if err != nil {
+			logger.Error(err)
+			return 0, errors.New("Failed to deserialize user assets record: " + row.Columns[0].GetString_())
+		}
+		for _, e := range view_entries(record) {
+			if e.assetId == assetId {
+				legacyUsers = append(legacyUsers, row.Columns[0].GetString_())
+				break
+			}
+		}
+	}
+	for _, userId := range legacyUsers {
+		err = a.ensure_migrated(stub, userId)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	rows, err := stub.GetRows(userAssetEntriesTable, []shim.Column{})
+	if err != nil {
+		logger.Error(err)
+		return 0, errors.New("Failed to get user asset entries")
+	}
+
+	// Collect first, the table is not written while it is being read
+	keys := make([][]shim.Column, 0)
+	for row := range rows {
+		if row.Columns[2].GetString_() == assetId {
+			keys = append(keys, entry_key(row.Columns[0].GetString_(), row.Columns[1].GetString_(), assetId))
+		}
+	}
+
+	for _, key := range keys {
+		err = stub.DeleteRow(userAssetEntriesTable, key)
+		if err != nil {
+			logger.Error(err)
+			return 0, errors.New("Failed to delete user asset entries of asset " + assetId)
+		}
+	}
+	return len(keys), nil
+}
+
+// Moves every legacy UserAssets row to the per-asset layout, returning the migrated user ids
+func (a *UserManager) MigrateAll(stub shim.ChaincodeStubInterface) ([]string, error) {
+	rows, err := stub.GetRows(userAssetsTable, []shim.Column{})
+	if err != nil {
+		logger.Error(err)
+		return nil, errors.New("Failed to get legacy user asset records")
+	}
+
+	userIds := make([]string, 0)
+	for row := range rows {
+		userIds = append(userIds, row.Columns[0].GetString_())
+	}
+
+	for _, userId := range userIds {
+		err = a.ensure_migrated(stub, userId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return userIds, nil
+}
+
+// Rewrites every user asset entry at the current schema version, returning
+// the number of entries rewritten
+func (a *UserManager) MigrateEntries(stub shim.ChaincodeStubInterface) (int, error) {
+	rows, err := stub.GetRows(userAssetEntriesTable, []shim.Column{})
+	if err != nil {
+		logger.Error(err)
+		return 0, errors.New("Failed to get user asset entries")
+	}
+
+	// Collect first, the table is not written while it is being read
+	entries := make([]shim.Row, 0)
+	for row := range rows {
+		entries = append(entries, row)
+	}
+
+	for _, row := range entries {
+		userId := row.Columns[0].GetString_()
+		category := row.Columns[1].GetString_()
+		assetId := row.Columns[2].GetString_()
+
+		var view common.UserAssetsRecord
+		view.Init()
+		err = put_view_entry(&view, category, assetId, row.Columns[3].GetBytes())
+		if err != nil {
+			logger.Error(err)
+			return 0, fmt.Errorf("Failed to deserialize user asset entry %s/%s/%s", userId, category, assetId)
+		}
+
+		err = a.PutEntry(stub, userId, category, assetId, view_entries(view)[0].value)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(entries), nil
+}
+
+// Moves the user's legacy blob, if any, to the per-asset layout. Entries
+// already present in the new layout take precedence over the legacy ones.
+func (a *UserManager) ensure_migrated(stub shim.ChaincodeStubInterface, userId string) error {
+	legacy, err := a.get_legacy_row(stub, userId)
+	if err != nil {
+		logger.Error(err)
+		return errors.New("Failed to get legacy record for enrollment id : " + userId)
+	}
+	if len(legacy.Columns) == 0 {
+		return nil
+	}
+
+	logger.Debugf("Migrating legacy user asset record %s", userId)
+	var record common.UserAssetsRecord
+	err = record.Decode(legacy.Columns[1].GetBytes())
+	if err != nil {
+		logger.Error(err)
+		return errors.New("Failed to deserialize user assets record: " + userId)
+	}
+
+	entries := view_entries(record)
+	for _, e := range entries {
+		bytes, err := common.EncodeUserAssetEntry(e.value)
+		if err != nil {
+			logger.Error(err)
+			return errors.New("Failed to serialize user asset entry")
+		}
+		_, err = stub.InsertRow(userAssetEntriesTable, shim.Row{
 			Columns: []*shim.Column{
 				{Value: &shim.Column_String_{String_: userId}},
-				{Value: &shim.Column_Bytes{Bytes: []byte(recordBytes)}}},
+				{Value: &shim.Column_String_{String_: e.category}},
+				{Value: &shim.Column_String_{String_: e.assetId}},
+				{Value: &shim.Column_Bytes{Bytes: bytes}}},
 		})
+		if err != nil {
+			logger.Error(err)
+			return fmt.Errorf("Failed to migrate user asset entry %s/%s/%s", userId, e.category, e.assetId)
+		}
 	}
+
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: userId}}
+	columns = append(columns, col1)
+	return stub.DeleteRow(userAssetsTable, columns)
 }
 
-func (a *UserManager) get_or_create_record(stub shim.ChaincodeStubInterface, userId string) (common.UserAssetsRecord, error) {
+func (a *UserManager) get_legacy_record(stub shim.ChaincodeStubInterface, userId string) (common.UserAssetsRecord, error) {
 	var r common.UserAssetsRecord
 
-	existing, err := a.get_record(stub, userId)
-	// TODO use err
+	existing, err := a.get_legacy_row(stub, userId)
+	if err != nil {
+		logger.Error(err)
+		return r, errors.New("Failed to get legacy record for enrollment id : " + userId)
+	}
 	if len(existing.Columns) > 0 {
-		logger.Debug("Record exists : " + userId)
 		err = r.Decode(existing.Columns[1].GetBytes())
 		if err != nil {
 			logger.Error(err)
@@ -87,15 +329,116 @@ func (a *UserManager) get_or_create_record(stub shim.ChaincodeStubInterface, use
 		}
 		return r, nil
 	} else {
-		logger.Debug("Creating non-existant record : " + userId)
 		r.Init()
 		return r, nil
 	}
 }
 
-func (a *UserManager) get_record(stub shim.ChaincodeStubInterface, userId string) (shim.Row, error) {
+// The serialized entry from the user's legacy blob, nil if there is none
+func (a *UserManager) get_legacy_entry(stub shim.ChaincodeStubInterface, userId string, category string, assetId string) ([]byte, error) {
+	record, err := a.get_legacy_record(stub, userId)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range view_entries(record) {
+		if e.category == category && e.assetId == assetId {
+			return common.EncodeUserAssetEntry(e.value)
+		}
+	}
+	return nil, nil
+}
+
+func (a *UserManager) get_legacy_row(stub shim.ChaincodeStubInterface, userId string) (shim.Row, error) {
 	var columns []shim.Column
 	col1 := shim.Column{Value: &shim.Column_String_{String_: userId}}
 	columns = append(columns, col1)
 	return stub.GetRow(userAssetsTable, columns)
 }
+
+func (a *UserManager) get_entry_row(stub shim.ChaincodeStubInterface, userId string, category string, assetId string) (shim.Row, error) {
+	return stub.GetRow(userAssetEntriesTable, entry_key(userId, category, assetId))
+}
+
+func entry_key(userId string, category string, assetId string) []shim.Column {
+	return []shim.Column{
+		{Value: &shim.Column_String_{String_: userId}},
+		{Value: &shim.Column_String_{String_: category}},
+		{Value: &shim.Column_String_{String_: assetId}},
+	}
+}
+
+type viewEntry struct {
+	category string
+	assetId  string
+	value    interface{}
+}
+
+func view_entries(r common.UserAssetsRecord) []viewEntry {
+	entries := make([]viewEntry, 0)
+	for k, v := range r.Submissions {
+		entries = append(entries, viewEntry{common.UA_SUBMISSIONS, k, v})
+	}
+	for k, v := range r.Requests {
+		entries = append(entries, viewEntry{common.UA_REQUESTS, k, v})
+	}
+	for k, v := range r.Proposals {
+		entries = append(entries, viewEntry{common.UA_PROPOSALS, k, v})
+	}
+	for k, v := range r.Accepted {
+		entries = append(entries, viewEntry{common.UA_ACCEPTED, k, v})
+	}
+	for k, v := range r.Rejected {
+		entries = append(entries, viewEntry{common.UA_REJECTED, k, v})
+	}
+	for k, v := range r.Contracts {
+		entries = append(entries, viewEntry{common.UA_CONTRACTS, k, v})
+	}
+	for k, v := range r.Shared {
+		entries = append(entries, viewEntry{common.UA_SHARED, k, v})
+	}
+	return entries
+}
+
+func put_view_entry(r *common.UserAssetsRecord, category string, assetId string, bytes []byte) error {
+	var err error
+	switch category {
+	case common.UA_SUBMISSIONS:
+		var v common.SubmissionRecord
+		err = json.Unmarshal(bytes, &v)
+		common.UpgradeUserAssetEntry(&v)
+		r.Submissions[assetId] = v
+	case common.UA_REQUESTS:
+		var v common.RequestRecord
+		err = json.Unmarshal(bytes, &v)
+		common.UpgradeUserAssetEntry(&v)
+		r.Requests[assetId] = v
+	case common.UA_PROPOSALS:
+		var v common.ProposalRecord
+		err = json.Unmarshal(bytes, &v)
+		common.UpgradeUserAssetEntry(&v)
+		r.Proposals[assetId] = v
+	case common.UA_ACCEPTED:
+		var v common.AcceptedProposal
+		err = json.Unmarshal(bytes, &v)
+		common.UpgradeUserAssetEntry(&v)
+		r.Accepted[assetId] = v
+	case common.UA_REJECTED:
+		var v common.RejectedProposal
+		err = json.Unmarshal(bytes, &v)
+		common.UpgradeUserAssetEntry(&v)
+		r.Rejected[assetId] = v
+	case common.UA_CONTRACTS:
+		var v common.SubmissionRecord
+		err = json.Unmarshal(bytes, &v)
+		common.UpgradeUserAssetEntry(&v)
+		r.Contracts[assetId] = v
+	case common.UA_SHARED:
+		var v common.SharedRecord
+		err = json.Unmarshal(bytes, &v)
+		common.UpgradeUserAssetEntry(&v)
+		r.Shared[assetId] = v
+	default:
+		err = errors.New("Unrecognized user assets category : " + category)
+	}
+	return err
+}
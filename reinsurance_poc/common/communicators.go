@@ -2,42 +2,258 @@ package common
 
 import (
 	"errors"
-
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	"github.com/hyperledger/fabric/core/util"
 )
 
+// Talks to asset management on behalf of the other chaincodes. The deployed
+// name of asset management is kept in the chaincode's state, see SetCCName.
+// Every call to another chaincode carries the caller token set with
+// SetCallerToken, which lets the callee verify through asset management which
+// registered chaincode made it.
 type AssetManagementCommunicator struct {
-	CCName string
+	// Rights answered by asset management during the current transaction,
+	// keyed by enrollmentId|assetId, until the transaction invokes any
+	// chaincode
+	mu          sync.Mutex
+	cacheTxId   string
+	rightsCache map[string]AssetRightsResponse
 }
 
 func (a *AssetManagementCommunicator) AssertHasAssetRights(stub shim.ChaincodeStubInterface, assetId string, rights []AssetRight) error {
-	enrollmentId, err := a.GetEnrollmentAttr(stub)
+	return a.AssertHasAssetsRights(stub, []string{assetId}, rights)
+}
+
+// Asserts the caller holds the rights on every asset
+func (a *AssetManagementCommunicator) AssertHasAssetsRights(stub shim.ChaincodeStubInterface, assetIds []string, rights []AssetRight) error {
+	responses, err := a.GetAssetsRights(stub, assetIds)
 	if err != nil {
 		return err
 	}
 
-	invokeArgs := util.ToChaincodeArgs(AM_GET_AST_RIGHTS_ARG, enrollmentId, assetId)
-	bytes, err := stub.QueryChaincode(a.CCName, invokeArgs)
-	var response AssetRightsResponse
-	if err := response.Decode(bytes); err != nil {
-		return fmt.Errorf("Failed to deserialize AssetRightsRespnse due to %s", err)
+	for _, assetId := range assetIds {
+		response := responses[assetId]
+		if !response.Exists {
+			return errors.New("No such asset id " + assetId)
+		}
+
+		for _, right := range rights {
+			if !response.Contains(right) {
+				return fmt.Errorf("Insuffienct rights on asset %s. Missing %d", assetId, right)
+			}
+		}
+	}
+
+	return nil
+}
+
+// The caller's rights on each asset. Assets not yet asked about in this
+// transaction are fetched from asset management in a single query.
+func (a *AssetManagementCommunicator) GetAssetsRights(stub shim.ChaincodeStubInterface, assetIds []string) (map[string]AssetRightsResponse, error) {
+	enrollmentId, err := a.GetEnrollmentAttr(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	txId := stub.GetTxID()
+	if a.rightsCache == nil || a.cacheTxId != txId {
+		a.cacheTxId = txId
+		a.rightsCache = make(map[string]AssetRightsResponse)
 	}
 
-	if !response.Exists {
-		return errors.New("No such asset id " + assetId)
+	missing := make([]string, 0)
+	for _, assetId := range assetIds {
+		if _, ok := a.rightsCache[enrollmentId+"|"+assetId]; !ok && !ContainsString(missing, assetId) {
+			missing = append(missing, assetId)
+		}
 	}
 
-	for _, right := range rights {
-		if !response.Contains(right) {
-			return fmt.Errorf("Insuffienct rights on asset %s. Missing %d", assetId, right)
+	if len(missing) > 0 {
+		bytes, err := a.query(stub, AM_GET_ASTS_RIGHTS_ARG, enrollmentId, strings.Join(missing, ","))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to query asset_management for asset rights due to %s", err)
+		}
+
+		var response BulkAssetRightsResponse
+		if err := response.Decode(bytes); err != nil {
+			return nil, fmt.Errorf("Failed to deserialize BulkAssetRightsResponse due to %s", err)
+		}
+		for _, assetId := range missing {
+			a.rightsCache[enrollmentId+"|"+assetId] = response.Assets[assetId]
 		}
 	}
 
+	result := make(map[string]AssetRightsResponse)
+	for _, assetId := range assetIds {
+		result[assetId] = a.rightsCache[enrollmentId+"|"+assetId]
+	}
+	return result, nil
+}
+
+// Records the deployed name of asset management in the chaincode's state,
+// at Init and whenever asset management is redeployed
+func (a *AssetManagementCommunicator) SetCCName(stub shim.ChaincodeStubInterface, ccName string) error {
+	if ccName == "" {
+		return errors.New("Asset management chaincode name must not be empty")
+	}
+	err := stub.PutState(AM_CC_NAME_KEY, []byte(ccName))
+	if err != nil {
+		return fmt.Errorf("Failed to save asset management chaincode name due to : %s", err)
+	}
+	return nil
+}
+
+func (a *AssetManagementCommunicator) GetCCName(stub shim.ChaincodeStubInterface) (string, error) {
+	bytes, err := stub.GetState(AM_CC_NAME_KEY)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get asset management chaincode name due to : %s", err)
+	}
+	if len(bytes) == 0 {
+		return "", errors.New("Asset management chaincode name is not set")
+	}
+	return string(bytes), nil
+}
+
+// Records the token the chaincode proves itself with on cross-chaincode
+// calls. Asset management must be given the same token when registering it.
+func (a *AssetManagementCommunicator) SetCallerToken(stub shim.ChaincodeStubInterface, token string) error {
+	if token == "" {
+		return errors.New("Caller token must not be empty")
+	}
+	err := stub.PutState(CALLER_TOKEN_KEY, []byte(token))
+	if err != nil {
+		return fmt.Errorf("Failed to save caller token due to : %s", err)
+	}
 	return nil
+}
+
+func (a *AssetManagementCommunicator) callerProof(stub shim.ChaincodeStubInterface) (string, error) {
+	bytes, err := stub.GetState(CALLER_TOKEN_KEY)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get caller token due to : %s", err)
+	}
+	if len(bytes) == 0 {
+		return "", errors.New("Caller token is not set")
+	}
+	return CALLER_PROOF_PREFIX + string(bytes), nil
+}
+
+// Invokes another chaincode, appending the caller proof to the args. Every
+// invoke of another chaincode goes through here: it may change rights
+// answered earlier in the transaction, directly or through asset
+// management, so those are forgotten once it returns. Rights cached by a
+// nested call back into this chaincode are forgotten with them.
+func (a *AssetManagementCommunicator) invokeChaincode(stub shim.ChaincodeStubInterface, ccName string, args ...string) ([]byte, error) {
+	proof, err := a.callerProof(stub)
+	if err != nil {
+		return nil, err
+	}
+	defer a.clearRights()
+
+	callArgs := append(make([]string, 0, len(args)+1), args...)
+	return stub.InvokeChaincode(ccName, util.ToChaincodeArgs(append(callArgs, proof)...))
+}
 
+func (a *AssetManagementCommunicator) clearRights() {
+	a.mu.Lock()
+	a.rightsCache = nil
+	a.mu.Unlock()
+}
+
+// Queries another chaincode, appending the caller proof to the args
+func (a *AssetManagementCommunicator) queryChaincode(stub shim.ChaincodeStubInterface, ccName string, args ...string) ([]byte, error) {
+	proof, err := a.callerProof(stub)
+	if err != nil {
+		return nil, err
+	}
+	callArgs := append(make([]string, 0, len(args)+1), args...)
+	return stub.QueryChaincode(ccName, util.ToChaincodeArgs(append(callArgs, proof)...))
+}
+
+// The logical name of the registered chaincode that made the call carrying
+// the proof, i.e. SVC_PROPOSAL. Fails if the proof is empty or unknown.
+func (a *AssetManagementCommunicator) VerifyCaller(stub shim.ChaincodeStubInterface, proof string) (string, error) {
+	if proof == "" {
+		return "", errors.New("The call carries no caller proof")
+	}
+	bytes, err := a.query(stub, AM_VERIFY_CALLER_ARG, proof)
+	if err != nil {
+		return "", fmt.Errorf("Failed to verify caller due to %s", err)
+	}
+
+	var response CCNameResponse
+	if err := response.Decode(bytes); err != nil {
+		return "", fmt.Errorf("Failed to deserialize CCNameResponse due to %s", err)
+	}
+	return response.Name, nil
+}
+
+// The deployed name of the chaincode registered under the logical name, i.e. SVC_REQUEST
+func (a *AssetManagementCommunicator) ResolveChaincode(stub shim.ChaincodeStubInterface, serviceName string) (string, error) {
+	bytes, err := a.query(stub, AM_RESOLVE_CC_ARG, serviceName)
+	if err != nil {
+		return "", fmt.Errorf("Failed to resolve chaincode %s due to %s", serviceName, err)
+	}
+
+	var response CCNameResponse
+	if err := response.Decode(bytes); err != nil {
+		return "", fmt.Errorf("Failed to deserialize CCNameResponse due to %s", err)
+	}
+	return response.Name, nil
+}
+
+// Invokes asset management
+func (a *AssetManagementCommunicator) Invoke(stub shim.ChaincodeStubInterface, args ...string) ([]byte, error) {
+	ccName, err := a.GetCCName(stub)
+	if err != nil {
+		return nil, err
+	}
+	return a.invokeChaincode(stub, ccName, args...)
+}
+
+func (a *AssetManagementCommunicator) query(stub shim.ChaincodeStubInterface, args ...string) ([]byte, error) {
+	ccName, err := a.GetCCName(stub)
+	if err != nil {
+		return nil, err
+	}
+	return a.queryChaincode(stub, ccName, args...)
+}
+
+func (a *AssetManagementCommunicator) AssetExists(stub shim.ChaincodeStubInterface, assetId string) (bool, error) {
+	bytes, err := a.query(stub, AM_ASSET_EXISTS_ARG, assetId)
+	if err != nil {
+		return false, fmt.Errorf("Failed to query asset_management for asset %s due to %s", assetId, err)
+	}
+
+	var response AssetExistsResponse
+	if err := response.Decode(bytes); err != nil {
+		return false, fmt.Errorf("Failed to deserialize AssetExistsResponse due to %s", err)
+	}
+
+	return response.Exists, nil
+}
+
+// Metadata and parties of an asset the caller may view
+func (a *AssetManagementCommunicator) GetAssetInfo(stub shim.ChaincodeStubInterface, assetId string) (AssetInfo, error) {
+	var response AssetInfo
+	bytes, err := a.query(stub, AM_GET_ASSET_INFO_ARG, assetId)
+	if err != nil {
+		return response, fmt.Errorf("Failed to query asset_management for asset %s due to %s", assetId, err)
+	}
+
+	if err := response.Decode(bytes); err != nil {
+		return response, fmt.Errorf("Failed to deserialize AssetInfo due to %s", err)
+	}
+
+	return response, nil
 }
 
 func (a *AssetManagementCommunicator) GetEnrollmentAttr(stub shim.ChaincodeStubInterface) (string, error) {
@@ -47,3 +263,81 @@ func (a *AssetManagementCommunicator) GetEnrollmentAttr(stub shim.ChaincodeStubI
 	}
 	return string(bytes), nil
 }
+
+// Talks to reinsurance_request, resolved through the asset management
+// registry on every call so a redeployed request chaincode is picked up
+type RequestCommunicator struct {
+	AMComm *AssetManagementCommunicator
+}
+
+func (r *RequestCommunicator) ccName(stub shim.ChaincodeStubInterface) (string, error) {
+	return r.AMComm.ResolveChaincode(stub, SVC_REQUEST)
+}
+
+// Fetches a request the caller may view
+func (r *RequestCommunicator) GetRequest(stub shim.ChaincodeStubInterface, requestId string) (ReinsuranceRequest, error) {
+	var request ReinsuranceRequest
+	ccName, err := r.ccName(stub)
+	if err != nil {
+		return request, err
+	}
+
+	bytes, err := r.AMComm.queryChaincode(stub, ccName, RR_GET_REQ_ARG, requestId)
+	if err != nil {
+		return request, fmt.Errorf("Failed to query reinsurance_request for request %s due to %s", requestId, err)
+	}
+	if err := request.Decode(bytes); err != nil {
+		return request, fmt.Errorf("Failed to deserialize ReinsuranceRequest due to %s", err)
+	}
+	return request, nil
+}
+
+// Moves a request to a new lifecycle status, reason is recorded with it
+func (r *RequestCommunicator) Transition(stub shim.ChaincodeStubInterface, requestId string, status string, reason string) error {
+	ccName, err := r.ccName(stub)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.AMComm.invokeChaincode(stub, ccName, RR_TRANSITION_ARG, requestId, status, reason)
+	if err != nil {
+		return fmt.Errorf("Failed to move request %s to %s due to %s", requestId, status, err)
+	}
+	return nil
+}
+
+// Talks to reinsurance_proposal, resolved through the asset management
+// registry like RequestCommunicator
+type ProposalCommunicator struct {
+	AMComm *AssetManagementCommunicator
+}
+
+// Voids the open proposals of a request that no longer takes any, only
+// reinsurance_request may ask
+func (p *ProposalCommunicator) VoidProposals(stub shim.ChaincodeStubInterface, requestId string) error {
+	ccName, err := p.AMComm.ResolveChaincode(stub, SVC_PROPOSAL)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.AMComm.invokeChaincode(stub, ccName, RP_VOID_ARG, requestId)
+	if err != nil {
+		return fmt.Errorf("Failed to void proposals of request %s due to %s", requestId, err)
+	}
+	return nil
+}
+
+// Flags the open proposals quoted against an earlier revision of the
+// request, only reinsurance_request may ask
+func (p *ProposalCommunicator) FlagStaleProposals(stub shim.ChaincodeStubInterface, requestId string, revision int) error {
+	ccName, err := p.AMComm.ResolveChaincode(stub, SVC_PROPOSAL)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.AMComm.invokeChaincode(stub, ccName, RP_FLAG_STALE_ARG, requestId, strconv.Itoa(revision))
+	if err != nil {
+		return fmt.Errorf("Failed to flag stale proposals of request %s due to %s", requestId, err)
+	}
+	return nil
+}
@@ -1,5 +1,11 @@
 package common
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
 type AssetRight int32
 
 const (
@@ -9,30 +15,148 @@ const (
 	AUPDATER  AssetRight = 3
 )
 
+// Parses a comma separated list of numeric rights, i.e. "1,3"
+func ParseAssetRights(s string) ([]AssetRight, error) {
+	rights := make([]AssetRight, 0)
+	for _, e := range strings.Split(s, ",") {
+		v, err := strconv.ParseInt(strings.TrimSpace(e), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid asset right %s", e)
+		}
+		right := AssetRight(v)
+		if !IsValidAssetRight(right) {
+			return nil, fmt.Errorf("Unknown asset right %d", right)
+		}
+		rights = append(rights, right)
+	}
+	return rights, nil
+}
+
+func IsValidAssetRight(right AssetRight) bool {
+	return right >= AOWNER && right <= AUPDATER
+}
+
+// Role templates, each granting a configurable set of rights per asset type
+const (
+	ROLE_CEDENT_UW     = "cedent-underwriter"
+	ROLE_REINSURER_UW  = "reinsurer-underwriter"
+	ROLE_REINSURER_ORG = "reinsurer-organization"
+	ROLE_BROKER        = "broker"
+)
+
+// Cert attribute carrying the role of a user
+const (
+	ROLE_ATTR  = "role"
+	ADMIN_ROLE = "admin"
+)
+
+// Cert attribute carrying the organization (membersrvc affiliation) of a user
+const AFFILIATION_ATTR = "affiliation"
+
+// Rights and user asset records of an organization are kept under
+// the principal "org:[affiliation]" and apply to all its members
+const ORG_PRINCIPAL_PREFIX = "org:"
+
+func OrgPrincipal(affiliation string) string {
+	return ORG_PRINCIPAL_PREFIX + affiliation
+}
+
+func IsOrgPrincipal(principal string) bool {
+	return strings.HasPrefix(principal, ORG_PRINCIPAL_PREFIX)
+}
+
+// Categories of a UserAssetsRecord
 const (
-	request_cc_id  = "reinsurance_request"
-	proposal_cc_id = "reinsurance_proposal"
+	UA_SUBMISSIONS = "submissions"
+	UA_REQUESTS    = "requests"
+	UA_PROPOSALS   = "proposals"
+	UA_ACCEPTED    = "accepted"
+	UA_REJECTED    = "rejected"
+	UA_CONTRACTS   = "contracts"
+	UA_SHARED      = "shared"
+)
+
+// Types of the assets tracked by asset management
+const (
+	ASSET_REQUEST  = "request"
+	ASSET_PROPOSAL = "proposal"
+	ASSET_CONTRACT = "contract"
+)
+
+// Logical names of the chaincodes in the asset management service registry
+const (
+	SVC_REQUEST    = "reinsurance_request"
+	SVC_PROPOSAL   = "reinsurance_proposal"
+	SVC_ENROLLMENT = "enrollment_service"
+)
+
+// State key under which the other chaincodes keep the deployed name of
+// asset management, the root of the service registry
+const AM_CC_NAME_KEY = "AssetManagementCC"
+
+// State key under which the other chaincodes keep the caller token asset
+// management registered them with, and the prefix marking the arg that
+// carries it on their cross-chaincode calls
+const (
+	CALLER_TOKEN_KEY    = "CallerToken"
+	CALLER_PROOF_PREFIX = "caller_proof:"
 )
 
 // Chaincode args
 const (
-	INIT_ARG              = "init"
-	AM_REGISTER_CC_ARG    = "register_chaincode"
-	AM_NEW_REQ_ARG        = "new_request"
-	AM_NEW_BID_ARG        = "new_proposal"
-	AM_NEW_CNTR_ARG       = "new_counter"
-	AM_ACCEPT_ARG         = "accepted_proposal"
-	AM_REJECT_ARG         = "rejected_proposal"
-	AM_GET_CC_NAME_ARG    = "get_cc_name"
-	AM_GET_U_ASST_ARG     = "get_user_assets"
-	AM_GET_AST_RIGHTS_ARG = "get_asset_rights"
-
-	RR_SUBMIT_ARG  = "submit"
-	RR_GET_REQ_ARG = "get_request"
-
-	RP_PROPOSE_ARG = "propose"
-	RP_COUNTER_ARG = "counter"
-	RP_ACCEPT_ARG  = "accept"
-	RP_REJECT_ARG  = "reject"
-	RP_GET_BID_ARG = "get_proposal"
+	INIT_ARG               = "init"
+	SET_AM_ARG             = "set_asset_management"
+	MIGRATE_ARG            = "migrate"
+	AM_REGISTER_CC_ARG     = "register_chaincode"
+	AM_NEW_REQ_ARG         = "new_request"
+	AM_NEW_BID_ARG         = "new_proposal"
+	AM_NEW_CNTR_ARG        = "new_counter"
+	AM_ACCEPT_ARG          = "accepted_proposal"
+	AM_REJECT_ARG          = "rejected_proposal"
+	AM_WITHDRAWN_ARG       = "withdrawn_request"
+	AM_EXPIRED_ARG         = "expired_request"
+	AM_INVITED_ARG         = "invited_requestees"
+	AM_REVOKE_ARG          = "revoke_rights"
+	AM_GRANT_ARG           = "grant_asset_rights"
+	AM_MIGRATE_UA_ARG      = "migrate_user_assets"
+	AM_SET_ROLE_ARG        = "set_role_template"
+	AM_GRANT_MANDATE_ARG   = "grant_mandate"
+	AM_REVOKE_MANDATE_ARG  = "revoke_mandate"
+	AM_ADD_AUDITOR_ARG     = "add_auditor"
+	AM_REMOVE_AUDITOR_ARG  = "remove_auditor"
+	AM_GET_CC_NAME_ARG     = "get_cc_name"
+	AM_RESOLVE_CC_ARG      = "resolve_chaincode"
+	AM_VERIFY_CALLER_ARG   = "verify_caller"
+	AM_GET_U_ASST_ARG      = "get_user_assets"
+	AM_GET_U_ASST_PG_ARG   = "get_user_assets_page"
+	AM_GET_AST_RIGHTS_ARG  = "get_asset_rights"
+	AM_GET_ASTS_RIGHTS_ARG = "get_assets_rights"
+	AM_ASSET_EXISTS_ARG    = "asset_exists"
+	AM_GET_HISTORY_ARG     = "get_asset_history"
+	AM_GET_CHILDREN_ARG    = "get_asset_children"
+	AM_GET_ROLES_ARG       = "get_role_templates"
+	AM_GET_MANDATES_ARG    = "get_mandates"
+	AM_GET_ASSET_INFO_ARG  = "get_asset_info"
+
+	AM_ADMIN_GET_AST_RIGHTS_ARG = "admin_get_asset_rights"
+
+	RR_SUBMIT_ARG       = "submit"
+	RR_SUBMIT_JSON_ARG  = "submit_json"
+	RR_GET_REQ_ARG      = "get_request"
+	RR_FIND_REQS_ARG    = "find_requests"
+	RR_TRANSITION_ARG   = "transition"
+	RR_WITHDRAW_ARG     = "withdraw"
+	RR_EXPIRE_ARG       = "expire"
+	RR_AMEND_ARG        = "amend"
+	RR_INVITE_ARG       = "invite"
+	RR_GET_VERSIONS_ARG = "get_request_versions"
+
+	RP_PROPOSE_ARG    = "propose"
+	RP_COUNTER_ARG    = "counter"
+	RP_ACCEPT_ARG     = "accept"
+	RP_REJECT_ARG     = "reject"
+	RP_VOID_ARG       = "void_proposals"
+	RP_FLAG_STALE_ARG = "flag_stale_proposals"
+	RP_GET_BID_ARG    = "get_proposal"
+	RP_GET_BIDS_ARG   = "get_proposals"
 )
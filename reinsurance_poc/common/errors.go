@@ -0,0 +1,43 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Returned when the caller of a chaincode function is not allowed to call it
+type AuthorizationError struct {
+	Function string
+	Caller   string
+	Reason   string
+}
+
+func (e *AuthorizationError) Error() string {
+	return fmt.Sprintf("Unauthorized call to %s by %s : %s", e.Function, e.Caller, e.Reason)
+}
+
+// One invalid field of a submitted document
+type ValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Every validation failure of a submitted document, reported together so the
+// submitter can fix them in one pass. Error() carries the list as JSON.
+type ValidationErrors []ValidationError
+
+func (v *ValidationErrors) Add(field string, message string) {
+	*v = append(*v, ValidationError{Field: field, Message: message})
+}
+
+func (v ValidationErrors) Encode() ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (v ValidationErrors) Error() string {
+	bytes, err := v.Encode()
+	if err != nil {
+		return fmt.Sprintf("Validation failed with %d errors", len(v))
+	}
+	return "Validation failed : " + string(bytes)
+}
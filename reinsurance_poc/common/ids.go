@@ -0,0 +1,55 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// State key prefix under which id counters are persisted, each as a plain
+// decimal count
+const idCounterKeyPrefix = "__id_counter_"
+
+// IdGenerator allocates sequential ids of the form [prefix]-[n]. The counter
+// for each prefix is kept in world state so ids survive chaincode restarts and
+// are identical on every peer. Ids already registered with asset_management
+// are skipped, so a redeployed chaincode starting from an empty state never
+// reuses an id that is still in use.
+type IdGenerator struct {
+	AMComm *AssetManagementCommunicator
+}
+
+func (g *IdGenerator) NextId(stub shim.ChaincodeStubInterface, prefix string) (string, error) {
+	key := idCounterKeyPrefix + prefix
+	bytes, err := stub.GetState(key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get id counter %s due to : %s", key, err)
+	}
+
+	var c uint64 = 0
+	if bytes != nil {
+		c, err = strconv.ParseUint(string(bytes), 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("Corrupt id counter %s : %s", key, err)
+		}
+	}
+
+	for {
+		c++
+		id := fmt.Sprintf("%s-%d", prefix, c)
+		exists, err := g.AMComm.AssetExists(stub, id)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			continue
+		}
+
+		err = stub.PutState(key, []byte(strconv.FormatUint(c, 10)))
+		if err != nil {
+			return "", fmt.Errorf("Failed to put id counter %s due to : %s", key, err)
+		}
+		return id, nil
+	}
+}
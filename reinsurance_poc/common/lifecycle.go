@@ -0,0 +1,49 @@
+package common
+
+// Lifecycle states of a ReinsuranceRequest
+const (
+	REQ_REQUESTED = "requested" // submitted, no proposal yet
+	REQ_QUOTING   = "quoting"   // at least one proposal received
+	REQ_BOUND     = "bound"     // a proposal was accepted
+	REQ_CLOSED    = "closed"    // the bound treaty is done with
+	REQ_WITHDRAWN = "withdrawn" // the requestor pulled the request
+	REQ_EXPIRED   = "expired"   // no proposal was accepted in time
+)
+
+// The states each state may move to. Closed, withdrawn and expired are final.
+var requestTransitions = map[string][]string{
+	REQ_REQUESTED: {REQ_QUOTING, REQ_WITHDRAWN, REQ_EXPIRED},
+	REQ_QUOTING:   {REQ_BOUND, REQ_WITHDRAWN, REQ_EXPIRED},
+	REQ_BOUND:     {REQ_CLOSED},
+	REQ_CLOSED:    {},
+	REQ_WITHDRAWN: {},
+	REQ_EXPIRED:   {},
+}
+
+func IsValidRequestStatus(status string) bool {
+	_, ok := requestTransitions[status]
+	return ok
+}
+
+func CanTransitionRequest(from string, to string) bool {
+	for _, s := range requestTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// True while proposals may still be made and answered
+func IsOpenRequestStatus(status string) bool {
+	return status == REQ_REQUESTED || status == REQ_QUOTING
+}
+
+// One recorded change of a request's status
+type StatusTransition struct {
+	From   string `json:"from"` // empty for the submission
+	To     string `json:"to"`
+	At     uint64 `json:"at"`
+	By     string `json:"by"`
+	Reason string `json:"reason"` // e.g. the accepted proposal id
+}
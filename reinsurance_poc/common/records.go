@@ -1,6 +1,9 @@
 package common
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"fmt"
+)
 
 type Record interface {
 	Encode() ([]byte, error)
@@ -9,10 +12,132 @@ type Record interface {
 }
 
 type AssetRecord struct {
-	Rights map[string][]AssetRight `json:"assetRights"`
+	Version int                      `json:"version"`
+	Type    string                   `json:"type"`
+	Creator string                   `json:"creator"`
+	Created uint64                   `json:"created"`
+	Parent  string                   `json:"parent"`
+	Rights  map[string][]AssetRight  `json:"assetRights"`
+	Windows map[string][]RightWindow `json:"rightWindows"`
+	Parties []AssetParty             `json:"parties"`
 }
 
+// Roles of the parties to a proposal
+const (
+	PARTY_REQUESTOR = "requestor"
+	PARTY_BIDDER    = "bidder"
+	PARTY_BROKER    = "broker"
+)
+
+// A party to an asset and the role it plays. Org is set when the party acts
+// through its organization, in which case the organization's records mirror
+// the party's.
+type AssetParty struct {
+	Id   string `json:"id"`
+	Role string `json:"role"`
+	Org  string `json:"org"`
+}
+
+func (arr *AssetRecord) GetParty(role string) (AssetParty, bool) {
+	for _, p := range arr.Parties {
+		if p.Role == role {
+			return p, true
+		}
+	}
+	return AssetParty{}, false
+}
+
+// The ids whose user asset records track the asset: each party and its organization
+func (arr *AssetRecord) PartyRecordIds() []string {
+	ids := make([]string, 0)
+	for _, p := range arr.Parties {
+		ids = append(ids, p.Id)
+		if p.Org != "" {
+			ids = append(ids, p.Org)
+		}
+	}
+	return ids
+}
+
+// Validity window of a granted right in unix milliseconds, a zero bound is open
+type RightWindow struct {
+	Right     AssetRight `json:"right"`
+	ValidFrom uint64     `json:"validFrom"`
+	ValidTo   uint64     `json:"validTo"`
+}
+
+func (w RightWindow) Contains(t uint64) bool {
+	return (w.ValidFrom == 0 || t >= w.ValidFrom) && (w.ValidTo == 0 || t <= w.ValidTo)
+}
+
+// Permanent rights are kept in Rights and time bound grants in Windows. A
+// user may hold a right both ways, the permanent one then prevails.
+
+// True if the user holds the right permanently or within any window
 func (arr *AssetRecord) UserHasRight(enrollId string, right AssetRight) bool {
+	if arr.hasPermanentRight(enrollId, right) {
+		return true
+	}
+	_, ok := arr.rightWindow(enrollId, right)
+	return ok
+}
+
+// True if the user holds the right permanently or t is within its window
+func (arr *AssetRecord) UserHasRightAt(enrollId string, right AssetRight, t uint64) bool {
+	if arr.hasPermanentRight(enrollId, right) {
+		return true
+	}
+	w, ok := arr.rightWindow(enrollId, right)
+	return ok && w.Contains(t)
+}
+
+// The rights of the user that are valid at t
+func (arr *AssetRecord) UserRightsAt(enrollId string, t uint64) []AssetRight {
+	rights := make([]AssetRight, 0)
+	for _, e := range arr.Rights[enrollId] {
+		rights = append(rights, e)
+	}
+	for _, w := range arr.Windows[enrollId] {
+		if w.Contains(t) && !arr.hasPermanentRight(enrollId, w.Right) {
+			rights = append(rights, w.Right)
+		}
+	}
+	return rights
+}
+
+// Assigns the rights permanently. Windows on the same rights are left in
+// place, they no longer matter while the permanent right is held.
+func (arr *AssetRecord) AssignUserRights(enrollId string, rights []AssetRight) {
+	for _, e := range rights {
+		arr.GiveRight(enrollId, e)
+	}
+}
+
+func (arr *AssetRecord) GiveRight(enrollId string, right AssetRight) {
+	if !arr.hasPermanentRight(enrollId, right) {
+		arr.Rights[enrollId] = append(arr.Rights[enrollId], right)
+	}
+}
+
+// Grants the rights, valid only between from and to, replacing any earlier
+// window on them. Rights the user holds permanently are left as they are, a
+// window never narrows them. With both bounds open the rights are assigned
+// permanently.
+func (arr *AssetRecord) AssignUserRightsWindow(enrollId string, rights []AssetRight, from uint64, to uint64) {
+	if from == 0 && to == 0 {
+		arr.AssignUserRights(enrollId, rights)
+		return
+	}
+	for _, e := range rights {
+		if arr.hasPermanentRight(enrollId, e) {
+			continue
+		}
+		arr.clearRightWindow(enrollId, e)
+		arr.Windows[enrollId] = append(arr.Windows[enrollId], RightWindow{Right: e, ValidFrom: from, ValidTo: to})
+	}
+}
+
+func (arr *AssetRecord) hasPermanentRight(enrollId string, right AssetRight) bool {
 	for _, e := range arr.Rights[enrollId] {
 		if e == right {
 			return true
@@ -21,49 +146,401 @@ func (arr *AssetRecord) UserHasRight(enrollId string, right AssetRight) bool {
 	return false
 }
 
-func (arr *AssetRecord) AssignUserRights(enrollId string, rights []AssetRight) {
-	if arr.Rights[enrollId] == nil {
-		arr.Rights[enrollId] = rights
-	} else {
-		for _, e := range rights {
-			arr.GiveRight(enrollId, e)
+func (arr *AssetRecord) rightWindow(enrollId string, right AssetRight) (RightWindow, bool) {
+	for _, w := range arr.Windows[enrollId] {
+		if w.Right == right {
+			return w, true
 		}
 	}
+	return RightWindow{}, false
 }
 
-func (arr *AssetRecord) GiveRight(enrollId string, right AssetRight) {
-	if !arr.UserHasRight(enrollId, right) {
-		arr.Rights[enrollId] = append(arr.Rights[enrollId], right)
+func (arr *AssetRecord) clearRightWindow(enrollId string, right AssetRight) {
+	windows := arr.Windows[enrollId]
+	for i, w := range windows {
+		if w.Right == right {
+			arr.Windows[enrollId] = append(windows[:i], windows[i+1:]...)
+			break
+		}
+	}
+	if len(arr.Windows[enrollId]) == 0 {
+		delete(arr.Windows, enrollId)
 	}
 }
 
+// Revokes the right however it is held, permanently or within a window
+func (arr *AssetRecord) RevokeRight(enrollId string, right AssetRight) {
+	arr.clearRightWindow(enrollId, right)
+	arr.removePermanentRight(enrollId, right)
+}
+
+func (arr *AssetRecord) removePermanentRight(enrollId string, right AssetRight) {
+	rights := arr.Rights[enrollId]
+	for i, e := range rights {
+		if e == right {
+			arr.Rights[enrollId] = append(rights[:i], rights[i+1:]...)
+			break
+		}
+	}
+	if len(arr.Rights[enrollId]) == 0 {
+		delete(arr.Rights, enrollId)
+	}
+}
+
+func (arr *AssetRecord) RemoveUser(enrollId string) {
+	delete(arr.Rights, enrollId)
+	delete(arr.Windows, enrollId)
+}
+
 func (r *AssetRecord) Encode() ([]byte, error) {
+	r.Version = ASSET_RECORD_VERSION
 	return json.Marshal(r)
 }
 
 func (r *AssetRecord) Decode(bytes []byte) error {
-	return json.Unmarshal(bytes, &r)
+	r.Init()
+	err := json.Unmarshal(bytes, &r)
+	if err != nil {
+		return err
+	}
+	r.upgrade()
+	return nil
+}
+
+func (r *AssetRecord) upgrade() {
+	switch r.Version {
+	case 0:
+		// Unversioned records predate windows and parties, or hold them as null
+		if r.Rights == nil {
+			r.Rights = make(map[string][]AssetRight)
+		}
+		if r.Windows == nil {
+			r.Windows = make(map[string][]RightWindow)
+		}
+		if r.Parties == nil {
+			r.Parties = make([]AssetParty, 0)
+		}
+		fallthrough
+	case 1:
+		// Windowed rights used to be listed in Rights too, with the window
+		// restricting them. Rights now only holds the permanent ones.
+		for id, windows := range r.Windows {
+			for _, w := range windows {
+				r.removePermanentRight(id, w.Right)
+			}
+		}
+	}
+	r.Version = ASSET_RECORD_VERSION
 }
 
 func (r *AssetRecord) Init() {
 	r.Rights = make(map[string][]AssetRight)
+	r.Windows = make(map[string][]RightWindow)
+}
+
+// A cedent's authorization for a broker to place business on its behalf.
+// The validity bounds are unix milliseconds, a zero bound is open.
+type Mandate struct {
+	Version   int    `json:"version"`
+	Cedent    string `json:"cedent"`
+	Broker    string `json:"broker"`
+	Granted   uint64 `json:"granted"`
+	ValidFrom uint64 `json:"validFrom"`
+	ValidTo   uint64 `json:"validTo"`
+}
+
+func (m *Mandate) ActiveAt(t uint64) bool {
+	return RightWindow{ValidFrom: m.ValidFrom, ValidTo: m.ValidTo}.Contains(t)
+}
+
+func (m *Mandate) Encode() ([]byte, error) {
+	m.Version = MANDATE_VERSION
+	return json.Marshal(m)
+}
+
+func (m *Mandate) Decode(bytes []byte) error {
+	err := json.Unmarshal(bytes, &m)
+	if err != nil {
+		return err
+	}
+	m.Version = MANDATE_VERSION
+	return nil
+}
+
+// A role template as given to and returned by the role template functions,
+// the templates are stored together in a RoleTemplatesRecord
+type RoleTemplate struct {
+	Name   string                  `json:"name"`
+	Rights map[string][]AssetRight `json:"rights"`
 }
 
+func (r *RoleTemplate) Encode() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+func (r *RoleTemplate) Decode(bytes []byte) error {
+	return json.Unmarshal(bytes, &r)
+}
+
+// The role templates an admin configured, keyed by role name and asset type
+type RoleTemplatesRecord struct {
+	Version   int                                `json:"version"`
+	Templates map[string]map[string][]AssetRight `json:"templates"`
+}
+
+func (r *RoleTemplatesRecord) Encode() ([]byte, error) {
+	r.Version = ROLE_TEMPLATES_VERSION
+	return json.Marshal(r)
+}
+
+func (r *RoleTemplatesRecord) Decode(bytes []byte) error {
+	err := json.Unmarshal(bytes, &r)
+	if err != nil || r.Version == 0 {
+		// Version 0 stored the bare map of templates
+		r.Templates = nil
+		err = json.Unmarshal(bytes, &r.Templates)
+		if err != nil {
+			return err
+		}
+	}
+	r.upgrade()
+	return nil
+}
+
+func (r *RoleTemplatesRecord) upgrade() {
+	if r.Templates == nil {
+		r.Templates = make(map[string]map[string][]AssetRight)
+	}
+	r.Version = ROLE_TEMPLATES_VERSION
+}
+
+// The users designated as auditors, sorted
+type AuditorsRecord struct {
+	Version  int      `json:"version"`
+	Auditors []string `json:"auditors"`
+}
+
+func (r *AuditorsRecord) Encode() ([]byte, error) {
+	r.Version = AUDITORS_VERSION
+	return json.Marshal(r)
+}
+
+func (r *AuditorsRecord) Decode(bytes []byte) error {
+	var err error
+	if len(bytes) > 0 && bytes[0] == '[' {
+		// Version 0 stored the bare list of auditors
+		err = json.Unmarshal(bytes, &r.Auditors)
+	} else {
+		err = json.Unmarshal(bytes, &r)
+	}
+	if err != nil {
+		return err
+	}
+	r.upgrade()
+	return nil
+}
+
+func (r *AuditorsRecord) upgrade() {
+	if r.Auditors == nil {
+		r.Auditors = make([]string, 0)
+	}
+	r.Version = AUDITORS_VERSION
+}
+
+// The rights an asset owner may grant to other users
+type DelegableRightsRecord struct {
+	Version int          `json:"version"`
+	Rights  []AssetRight `json:"rights"`
+}
+
+func (r *DelegableRightsRecord) Encode() ([]byte, error) {
+	r.Version = DELEGABLE_RIGHTS_VERSION
+	return json.Marshal(r)
+}
+
+func (r *DelegableRightsRecord) Decode(bytes []byte) error {
+	var err error
+	if len(bytes) > 0 && bytes[0] == '[' {
+		// Version 0 stored the bare list of rights
+		err = json.Unmarshal(bytes, &r.Rights)
+	} else {
+		err = json.Unmarshal(bytes, &r)
+	}
+	if err != nil {
+		return err
+	}
+	r.upgrade()
+	return nil
+}
+
+func (r *DelegableRightsRecord) upgrade() {
+	if r.Rights == nil {
+		r.Rights = make([]AssetRight, 0)
+	}
+	r.Version = DELEGABLE_RIGHTS_VERSION
+}
+
+// One action on an asset, with the asset's rights, windows and parties before
+// and after it
+type AssetHistoryEntry struct {
+	Version       int                      `json:"version"`
+	AssetId       string                   `json:"assetId"`
+	Seq           uint64                   `json:"seq"`
+	Actor         string                   `json:"actor"`
+	Action        string                   `json:"action"`
+	Before        map[string][]AssetRight  `json:"before"`
+	After         map[string][]AssetRight  `json:"after"`
+	BeforeWindows map[string][]RightWindow `json:"beforeWindows"`
+	AfterWindows  map[string][]RightWindow `json:"afterWindows"`
+	BeforeParties []AssetParty             `json:"beforeParties"`
+	AfterParties  []AssetParty             `json:"afterParties"`
+	Timestamp     uint64                   `json:"timestamp"`
+	TxId          string                   `json:"txId"`
+}
+
+func (r *AssetHistoryEntry) Encode() ([]byte, error) {
+	r.Version = HISTORY_ENTRY_VERSION
+	return json.Marshal(r)
+}
+
+func (r *AssetHistoryEntry) Decode(bytes []byte) error {
+	err := json.Unmarshal(bytes, &r)
+	if err != nil {
+		return err
+	}
+	r.upgrade()
+	return nil
+}
+
+func (r *AssetHistoryEntry) upgrade() {
+	switch r.Version {
+	case 0, 1:
+		// Entries before version 2 only recorded rights
+		if r.BeforeWindows == nil {
+			r.BeforeWindows = make(map[string][]RightWindow)
+		}
+		if r.AfterWindows == nil {
+			r.AfterWindows = make(map[string][]RightWindow)
+		}
+		if r.BeforeParties == nil {
+			r.BeforeParties = make([]AssetParty, 0)
+		}
+		if r.AfterParties == nil {
+			r.AfterParties = make([]AssetParty, 0)
+		}
+	}
+	r.Version = HISTORY_ENTRY_VERSION
+}
+
+type BySeq []AssetHistoryEntry
+
+func (s BySeq) Len() int           { return len(s) }
+func (s BySeq) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s BySeq) Less(i, j int) bool { return s[i].Seq < s[j].Seq }
+
 type UserAssetsRecord struct {
+	Version     int                         `json:"version"`
 	Submissions map[string]SubmissionRecord `json:"submissions"`
 	Requests    map[string]RequestRecord    `json:"requests"`
 	Proposals   map[string]ProposalRecord   `json:"proposals"`
 	Accepted    map[string]AcceptedProposal `json:"accepted"`
 	Rejected    map[string]RejectedProposal `json:"rejected"`
 	Contracts   map[string]SubmissionRecord `json:"contracts"`
+	Shared      map[string]SharedRecord     `json:"shared"`
+}
+
+// Adds the entries of other that are not already in the record
+func (r *UserAssetsRecord) Merge(other UserAssetsRecord) {
+	for k, v := range other.Submissions {
+		if _, ok := r.Submissions[k]; !ok {
+			r.Submissions[k] = v
+		}
+	}
+	for k, v := range other.Requests {
+		if _, ok := r.Requests[k]; !ok {
+			r.Requests[k] = v
+		}
+	}
+	for k, v := range other.Proposals {
+		if _, ok := r.Proposals[k]; !ok {
+			r.Proposals[k] = v
+		}
+	}
+	for k, v := range other.Accepted {
+		if _, ok := r.Accepted[k]; !ok {
+			r.Accepted[k] = v
+		}
+	}
+	for k, v := range other.Rejected {
+		if _, ok := r.Rejected[k]; !ok {
+			r.Rejected[k] = v
+		}
+	}
+	for k, v := range other.Contracts {
+		if _, ok := r.Contracts[k]; !ok {
+			r.Contracts[k] = v
+		}
+	}
+	for k, v := range other.Shared {
+		if _, ok := r.Shared[k]; !ok {
+			r.Shared[k] = v
+		}
+	}
 }
 
 func (r *UserAssetsRecord) Encode() ([]byte, error) {
+	r.Version = USER_ASSETS_VERSION
 	return json.Marshal(r)
 }
 
 func (r *UserAssetsRecord) Decode(bytes []byte) error {
-	return json.Unmarshal(bytes, &r)
+	// Init first so maps absent from older records are never nil
+	r.Init()
+	err := json.Unmarshal(bytes, &r)
+	if err != nil {
+		return err
+	}
+	r.upgrade()
+	return nil
+}
+
+func (r *UserAssetsRecord) upgrade() {
+	switch r.Version {
+	case 0:
+		// Unversioned records may hold null categories
+		other := *r
+		r.Init()
+		r.Merge(other)
+	}
+	for k, v := range r.Submissions {
+		UpgradeUserAssetEntry(&v)
+		r.Submissions[k] = v
+	}
+	for k, v := range r.Requests {
+		UpgradeUserAssetEntry(&v)
+		r.Requests[k] = v
+	}
+	for k, v := range r.Proposals {
+		UpgradeUserAssetEntry(&v)
+		r.Proposals[k] = v
+	}
+	for k, v := range r.Accepted {
+		UpgradeUserAssetEntry(&v)
+		r.Accepted[k] = v
+	}
+	for k, v := range r.Rejected {
+		UpgradeUserAssetEntry(&v)
+		r.Rejected[k] = v
+	}
+	for k, v := range r.Contracts {
+		UpgradeUserAssetEntry(&v)
+		r.Contracts[k] = v
+	}
+	for k, v := range r.Shared {
+		UpgradeUserAssetEntry(&v)
+		r.Shared[k] = v
+	}
+	r.Version = USER_ASSETS_VERSION
 }
 
 func (r *UserAssetsRecord) Init() {
@@ -73,73 +550,153 @@ func (r *UserAssetsRecord) Init() {
 	r.Accepted = make(map[string]AcceptedProposal, 0)
 	r.Rejected = make(map[string]RejectedProposal, 0)
 	r.Contracts = make(map[string]SubmissionRecord, 0)
+	r.Shared = make(map[string]SharedRecord, 0)
 }
 
 type SubmissionRecord struct {
+	Version      int      `json:"version"`
 	SubmissionId string   `json:"submissionId"`
+	Requestor    string   `json:"requestor"`
+	Broker       string   `json:"broker"`
 	Requestees   []string `json:"requestees"`
 	Created      uint64   `json:"created"`
 	Updated      uint64   `json:"updated"`
 }
 
 type RequestRecord struct {
+	Version      int    `json:"version"`
 	SubmissionId string `json:"submissionId"`
 	Requestor    string `json:"requestor"`
+	Broker       string `json:"broker"`
 	Created      uint64 `json:"created"`
 	Updated      uint64 `json:"updated"`
 }
 
 type ProposalRecord struct {
+	Version      int    `json:"version"`
 	SubmissionId string `json:"submissionId"`
 	ProposalId   string `json:"proposalId"`
+	Requestor    string `json:"requestor"`
+	Broker       string `json:"broker"`
+	Bidder       string `json:"bidder"`
 	Created      uint64 `json:"created"`
 	Updated      uint64 `json:"updated"`
 	UpdatedBy    string `json:"updatedBy"`
 }
 
+// An asset shared with the user by its owner
+type SharedRecord struct {
+	Version   int          `json:"version"`
+	AssetId   string       `json:"assetId"`
+	SharedBy  string       `json:"sharedBy"`
+	Rights    []AssetRight `json:"rights"`
+	Granted   uint64       `json:"granted"`
+	ValidFrom uint64       `json:"validFrom"`
+	ValidTo   uint64       `json:"validTo"`
+}
+
 type AcceptedProposal struct {
-	SubmissionId string `json:"submissionId"`
-	ProposalId   string `json:"proposalId"`
-	Accepted     uint64 `json:"accepted"`
+	Version      int      `json:"version"`
+	SubmissionId string   `json:"submissionId"`
+	ProposalId   string   `json:"proposalId"`
+	Parties      []string `json:"parties"`
+	Accepted     uint64   `json:"accepted"`
 }
 
 type RejectedProposal struct {
-	SubmissionId string `json:"submissionId"`
-	ProposalId   string `json:"proposalId"`
-	Rejected     uint64 `json:"rejected"`
+	Version      int      `json:"version"`
+	SubmissionId string   `json:"submissionId"`
+	ProposalId   string   `json:"proposalId"`
+	Parties      []string `json:"parties"`
+	Rejected     uint64   `json:"rejected"`
 }
 
 type ReinsuranceRequest struct {
-	Id           string   `json:"id"`
-	PortfolioSHA string   `json:"portfolioSha"`
-	PortfolioURL string   `json:"portfolioUrl"`
-	Status       string   `json:"status"`
-	Requestor    string   `json:"requestor"`
-	Requestees   []string `json:"requestees"`
-	ContractText string   `json:"contractText"` // TODO needed here?
-	ISQLSchema   string   `json:"iSQLSchema"`
-	ISQLVersion  string   `json:"iSQLVersion"`
-	Created      uint64   `json:"created"`
-	Updated      uint64   `json:"updated"`
+	Version      int                `json:"version"`
+	Id           string             `json:"id"`
+	PortfolioSHA string             `json:"portfolioSha"`
+	PortfolioURL string             `json:"portfolioUrl"`
+	Status       string             `json:"status"`
+	Requestor    string             `json:"requestor"`
+	Broker       string             `json:"broker"`
+	Requestees   []string           `json:"requestees"`
+	ContractText string             `json:"contractText"` // TODO needed here?
+	ISQLSchema   string             `json:"iSQLSchema"`
+	ISQLVersion  string             `json:"iSQLVersion"`
+	Created      uint64             `json:"created"`
+	Updated      uint64             `json:"updated"`
+	Revision     int                `json:"revision"` // counts amendments, from 1
+	Transitions  []StatusTransition `json:"transitions"`
+	TreatyTerms
 }
 
 func (r *ReinsuranceRequest) Encode() ([]byte, error) {
+	r.Version = REQUEST_VERSION
 	return json.Marshal(r)
 }
 
 func (r *ReinsuranceRequest) Decode(bytes []byte) error {
-	return json.Unmarshal(bytes, &r)
+	err := json.Unmarshal(bytes, &r)
+	if err != nil {
+		return err
+	}
+	r.upgrade()
+	return nil
+}
+
+func (r *ReinsuranceRequest) upgrade() {
+	switch r.Version {
+	case 0:
+		if r.Requestees == nil {
+			r.Requestees = make([]string, 0)
+		}
+		if r.Status == "" {
+			r.Status = REQ_REQUESTED
+		}
+		fallthrough
+	case 1:
+		// Version 1 predates the treaty terms, which stay empty
+		fallthrough
+	case 2:
+		// Version 2 predates the lifecycle, its status never left requested
+		if r.Transitions == nil {
+			r.Transitions = []StatusTransition{{To: r.Status, At: r.Created, By: r.Requestor}}
+		}
+		fallthrough
+	case 3:
+		// Version 3 predates amendments, every request is its first revision
+		if r.Revision == 0 {
+			r.Revision = 1
+		}
+	}
+	r.Version = REQUEST_VERSION
+}
+
+// Moves the request to a new status, recording the transition. Fails if the
+// lifecycle does not allow the move.
+func (r *ReinsuranceRequest) Transition(to string, at uint64, by string, reason string) error {
+	if !CanTransitionRequest(r.Status, to) {
+		return fmt.Errorf("Request %s cannot move from %s to %s", r.Id, r.Status, to)
+	}
+	r.Transitions = append(r.Transitions, StatusTransition{From: r.Status, To: to, At: at, By: by, Reason: reason})
+	r.Status = to
+	r.Updated = at
+	return nil
 }
 
 type ReinsuranceBid struct {
-	Id           string `json:"id"`
-	RequestId    string `json:"requestId"`
-	Bidder       string `json:"bidder"`
-	ContractText string `json:"contractText"`
-	Created      uint64 `json:"created"`
-	Updated      uint64 `json:"updated"`
-	UpdatedBy    string `json:"updatedBy"`
-	Status       string `json:"status"`
+	Version           int    `json:"version"`
+	Id                string `json:"id"`
+	RequestId         string `json:"requestId"`
+	Bidder            string `json:"bidder"`
+	ContractText      string `json:"contractText"`
+	Created           uint64 `json:"created"`
+	Updated           uint64 `json:"updated"`
+	UpdatedBy         string `json:"updatedBy"`
+	UpdatedOnBehalfOf string `json:"updatedOnBehalfOf"` // the requestor, when UpdatedBy is its broker
+	Status            string `json:"status"`
+	RequestRevision   int    `json:"requestRevision"` // revision of the request last quoted against
+	Stale             bool   `json:"stale"`           // the request was amended since
 }
 
 func (r *ReinsuranceBid) Init() {
@@ -150,13 +707,38 @@ func (r *ReinsuranceBid) Init() {
 	r.Created = 0
 	r.Updated = 0
 	r.UpdatedBy = ""
+	r.UpdatedOnBehalfOf = ""
 	r.Status = ""
+	r.RequestRevision = 0
+	r.Stale = false
 }
 
 func (r *ReinsuranceBid) Encode() ([]byte, error) {
+	r.Version = BID_VERSION
 	return json.Marshal(r)
 }
 
 func (r *ReinsuranceBid) Decode(bytes []byte) error {
-	return json.Unmarshal(bytes, &r)
+	err := json.Unmarshal(bytes, &r)
+	if err != nil {
+		return err
+	}
+	r.upgrade()
+	return nil
+}
+
+func (r *ReinsuranceBid) upgrade() {
+	switch r.Version {
+	case 0:
+		if r.Status == "" {
+			r.Status = "bid"
+		}
+		fallthrough
+	case 1:
+		// Version 1 predates amendments, bids quoted the first revision
+		if r.RequestRevision == 0 {
+			r.RequestRevision = 1
+		}
+	}
+	r.Version = BID_VERSION
 }
@@ -33,6 +33,71 @@ func BuildArr(exists bool, rights []AssetRight) AssetRightsResponse {
 	return AssetRightsResponse{Exists: exists, Rights: rights}
 }
 
+// Rights of one user on each of several assets, by asset id
+type BulkAssetRightsResponse struct {
+	Assets map[string]AssetRightsResponse
+}
+
+func (barr *BulkAssetRightsResponse) Encode() ([]byte, error) {
+	return json.Marshal(barr)
+}
+
+func (barr *BulkAssetRightsResponse) Decode(bytes []byte) error {
+	return json.Unmarshal(bytes, &barr)
+}
+
+type RequestsResponse struct {
+	Requests []ReinsuranceRequest `json:"requests"`
+}
+
+func (rr *RequestsResponse) Encode() ([]byte, error) {
+	return json.Marshal(rr)
+}
+
+func (rr *RequestsResponse) Decode(bytes []byte) error {
+	return json.Unmarshal(bytes, &rr)
+}
+
+type ProposalsResponse struct {
+	Proposals []ReinsuranceBid `json:"proposals"`
+}
+
+func (pr *ProposalsResponse) Encode() ([]byte, error) {
+	return json.Marshal(pr)
+}
+
+func (pr *ProposalsResponse) Decode(bytes []byte) error {
+	return json.Unmarshal(bytes, &pr)
+}
+
+// Permanent rights and time bound grants of every user on an asset
+type AllAssetRightsResponse struct {
+	Exists  bool
+	Rights  map[string][]AssetRight
+	Windows map[string][]RightWindow
+}
+
+func (aarr *AllAssetRightsResponse) Encode() ([]byte, error) {
+	return json.Marshal(aarr)
+}
+
+func (aarr *AllAssetRightsResponse) Decode(bytes []byte) error {
+	return json.Unmarshal(bytes, &aarr)
+}
+
+type AssetHistoryResponse struct {
+	AssetId string
+	Entries []AssetHistoryEntry
+}
+
+func (ahr *AssetHistoryResponse) Encode() ([]byte, error) {
+	return json.Marshal(ahr)
+}
+
+func (ahr *AssetHistoryResponse) Decode(bytes []byte) error {
+	return json.Unmarshal(bytes, &ahr)
+}
+
 type CCNameResponse struct {
 	Name string
 }
@@ -44,3 +109,113 @@ func (ccn *CCNameResponse) Encode() ([]byte, error) {
 func (ccn *CCNameResponse) Decode(bytes []byte) error {
 	return json.Unmarshal(bytes, &ccn)
 }
+
+type AssetExistsResponse struct {
+	Exists bool
+}
+
+func (aer *AssetExistsResponse) Encode() ([]byte, error) {
+	return json.Marshal(aer)
+}
+
+func (aer *AssetExistsResponse) Decode(bytes []byte) error {
+	return json.Unmarshal(bytes, &aer)
+}
+
+// What asset management knows of an asset besides its rights
+type AssetInfo struct {
+	AssetId string       `json:"assetId"`
+	Type    string       `json:"type"`
+	Creator string       `json:"creator"`
+	Created uint64       `json:"created"`
+	Parent  string       `json:"parent"`
+	Parties []AssetParty `json:"parties"`
+}
+
+func (r *AssetInfo) Encode() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+func (r *AssetInfo) Decode(bytes []byte) error {
+	return json.Unmarshal(bytes, &r)
+}
+
+// The children of an asset that the caller may view
+type AssetChildrenResponse struct {
+	ParentId string      `json:"parentId"`
+	Children []AssetInfo `json:"children"`
+}
+
+func (r *AssetChildrenResponse) Encode() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+func (r *AssetChildrenResponse) Decode(bytes []byte) error {
+	return json.Unmarshal(bytes, &r)
+}
+
+// The mandates a cedent has granted to brokers
+type MandatesResponse struct {
+	Mandates []Mandate `json:"mandates"`
+}
+
+func (r *MandatesResponse) Encode() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+func (r *MandatesResponse) Decode(bytes []byte) error {
+	return json.Unmarshal(bytes, &r)
+}
+
+type RoleTemplatesResponse struct {
+	Templates []RoleTemplate `json:"templates"`
+}
+
+func (r *RoleTemplatesResponse) Encode() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+func (r *RoleTemplatesResponse) Decode(bytes []byte) error {
+	return json.Unmarshal(bytes, &r)
+}
+
+// Query for one page of a single category of the caller's user assets.
+// Zero or empty fields do not filter.
+type UserAssetsQuery struct {
+	Category          string `json:"category"`
+	UpdatedFrom       uint64 `json:"updatedFrom"`
+	UpdatedTo         uint64 `json:"updatedTo"`
+	Counterparty      string `json:"counterparty"`
+	PageSize          int    `json:"pageSize"`
+	ContinuationToken string `json:"continuationToken"`
+}
+
+func (q *UserAssetsQuery) Encode() ([]byte, error) {
+	return json.Marshal(q)
+}
+
+func (q *UserAssetsQuery) Decode(bytes []byte) error {
+	return json.Unmarshal(bytes, &q)
+}
+
+type UserAssetEntry struct {
+	AssetId        string      `json:"assetId"`
+	Counterparties []string    `json:"counterparties"`
+	Updated        uint64      `json:"updated"`
+	Record         interface{} `json:"record"`
+}
+
+// Entries are sorted by Updated, newest first. ContinuationToken is empty on the last page.
+type UserAssetsPageResponse struct {
+	Category          string           `json:"category"`
+	Entries           []UserAssetEntry `json:"entries"`
+	ContinuationToken string           `json:"continuationToken"`
+}
+
+func (r *UserAssetsPageResponse) Encode() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+func (r *UserAssetsPageResponse) Decode(bytes []byte) error {
+	return json.Unmarshal(bytes, &r)
+}
@@ -0,0 +1,121 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Schema versions of the records kept on the ledger. Decoding a record of
+// an older version upgrades it in memory and the migrate invokes rewrite the
+// stored rows. Bump a version whenever its record's layout changes and teach
+// the record's upgrade() to bring the previous version forward.
+//
+// Two kinds of state carry no version. The registry rows of asset management
+// hold a single plain chaincode id or name per column, a different layout
+// would get a new table. The id counters of IdGenerator and the history
+// sequences hold a plain decimal count, which has no layout to change.
+const (
+	ASSET_RECORD_VERSION     = 2
+	HISTORY_ENTRY_VERSION    = 2
+	MANDATE_VERSION          = 1
+	USER_ASSETS_VERSION      = 1
+	REQUEST_VERSION          = 4
+	BID_VERSION              = 2
+	ROLE_TEMPLATES_VERSION   = 1
+	AUDITORS_VERSION         = 1
+	DELEGABLE_RIGHTS_VERSION = 1
+)
+
+// Encodes one of the category records of a UserAssetsRecord, stored as a
+// user asset entry, at the current version
+func EncodeUserAssetEntry(v interface{}) ([]byte, error) {
+	switch e := v.(type) {
+	case SubmissionRecord:
+		e.Version = USER_ASSETS_VERSION
+		return json.Marshal(e)
+	case RequestRecord:
+		e.Version = USER_ASSETS_VERSION
+		return json.Marshal(e)
+	case ProposalRecord:
+		e.Version = USER_ASSETS_VERSION
+		return json.Marshal(e)
+	case AcceptedProposal:
+		e.Version = USER_ASSETS_VERSION
+		return json.Marshal(e)
+	case RejectedProposal:
+		e.Version = USER_ASSETS_VERSION
+		return json.Marshal(e)
+	case SharedRecord:
+		e.Version = USER_ASSETS_VERSION
+		return json.Marshal(e)
+	default:
+		return json.Marshal(v)
+	}
+}
+
+// Upgrades a decoded user asset entry, given as a pointer to its category
+// record, to the current version
+func UpgradeUserAssetEntry(v interface{}) {
+	switch e := v.(type) {
+	case *SubmissionRecord:
+		if e.Version == 0 && e.Requestees == nil {
+			e.Requestees = make([]string, 0)
+		}
+		e.Version = USER_ASSETS_VERSION
+	case *RequestRecord:
+		e.Version = USER_ASSETS_VERSION
+	case *ProposalRecord:
+		e.Version = USER_ASSETS_VERSION
+	case *AcceptedProposal:
+		if e.Version == 0 && e.Parties == nil {
+			e.Parties = make([]string, 0)
+		}
+		e.Version = USER_ASSETS_VERSION
+	case *RejectedProposal:
+		if e.Version == 0 && e.Parties == nil {
+			e.Parties = make([]string, 0)
+		}
+		e.Version = USER_ASSETS_VERSION
+	case *SharedRecord:
+		if e.Version == 0 && e.Rights == nil {
+			e.Rights = make([]AssetRight, 0)
+		}
+		e.Version = USER_ASSETS_VERSION
+	}
+}
+
+// Rewrites every state record whose key starts with prefix, passing its bytes
+// through rewrite, and returns the number of records rewritten
+func MigrateState(stub shim.ChaincodeStubInterface, prefix string, rewrite func([]byte) ([]byte, error)) (int, error) {
+	iter, err := stub.RangeQueryState(prefix+"-", prefix+"-~")
+	if err != nil {
+		return 0, fmt.Errorf("Failed to query records with prefix %s due to : %s", prefix, err)
+	}
+
+	keys := make([]string, 0)
+	values := make([][]byte, 0)
+	for iter.HasNext() {
+		key, value, err := iter.Next()
+		if err != nil {
+			iter.Close()
+			return 0, fmt.Errorf("Failed to read records with prefix %s due to : %s", prefix, err)
+		}
+		keys = append(keys, key)
+		values = append(values, value)
+	}
+	iter.Close()
+
+	for i, key := range keys {
+		bytes, err := rewrite(values[i])
+		if err != nil {
+			return 0, fmt.Errorf("Failed to migrate record %s due to : %s", key, err)
+		}
+		err = stub.PutState(key, bytes)
+		if err != nil {
+			return 0, fmt.Errorf("Failed to save record %s due to : %s", key, err)
+		}
+	}
+	return len(keys), nil
+}
@@ -0,0 +1,191 @@
+package common
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// Structured terms of the treaty a request asks reinsurers to quote on.
+// Amounts are in whole currency units.
+type TreatyTerms struct {
+	ContractType      string `json:"contractType"`    // e.g. liability
+	ContractSubType   string `json:"contractSubType"` // e.g. facultative
+	AssetType         string `json:"assetType"`       // e.g. railroad
+	TotalInsuredValue int64  `json:"totalInsuredValue"`
+	AggregateLimit    int64  `json:"aggregateLimit"`
+	InExcessOf        int64  `json:"inExcessOf"` // the attachment point
+}
+
+// Whether any term was given, requests submitted positionally carry none
+func (t *TreatyTerms) HasTerms() bool {
+	return *t != TreatyTerms{}
+}
+
+// Adds a validation error for every inconsistent term
+func (t *TreatyTerms) Validate(verr *ValidationErrors) {
+	if t.ContractType == "" {
+		verr.Add("contractType", "contract type is required")
+	}
+	if t.AssetType == "" {
+		verr.Add("assetType", "asset type is required")
+	}
+	if t.TotalInsuredValue <= 0 {
+		verr.Add("totalInsuredValue", "total insured value must be positive")
+	}
+	if t.AggregateLimit <= 0 {
+		verr.Add("aggregateLimit", "aggregate limit must be positive")
+	}
+	if t.InExcessOf < 0 {
+		verr.Add("inExcessOf", "attachment cannot be negative")
+	} else if t.InExcessOf >= t.TotalInsuredValue {
+		verr.Add("inExcessOf", "attachment must be below the total insured value")
+	}
+}
+
+// Changes to an open request. Fields absent from the document keep their
+// value, fields given replace it even when empty or zero, so an attachment
+// may be amended down to 0 and a sub type cleared.
+type RequestAmendment struct {
+	PortfolioSHA      *string `json:"portfolioSha"`
+	PortfolioURL      *string `json:"portfolioUrl"`
+	ContractText      *string `json:"contractText"`
+	ISQLSchema        *string `json:"iSQLSchema"`
+	ISQLVersion       *string `json:"iSQLVersion"`
+	ContractType      *string `json:"contractType"`
+	ContractSubType   *string `json:"contractSubType"`
+	AssetType         *string `json:"assetType"`
+	TotalInsuredValue *int64  `json:"totalInsuredValue"`
+	AggregateLimit    *int64  `json:"aggregateLimit"`
+	InExcessOf        *int64  `json:"inExcessOf"`
+}
+
+func (a *RequestAmendment) Decode(bytes []byte) error {
+	return json.Unmarshal(bytes, &a)
+}
+
+// Applies the given fields to the request
+func (a *RequestAmendment) Apply(r *ReinsuranceRequest) {
+	setString(&r.PortfolioSHA, a.PortfolioSHA)
+	setString(&r.PortfolioURL, a.PortfolioURL)
+	setString(&r.ContractText, a.ContractText)
+	setString(&r.ISQLSchema, a.ISQLSchema)
+	setString(&r.ISQLVersion, a.ISQLVersion)
+	setString(&r.ContractType, a.ContractType)
+	setString(&r.ContractSubType, a.ContractSubType)
+	setString(&r.AssetType, a.AssetType)
+	setInt64(&r.TotalInsuredValue, a.TotalInsuredValue)
+	setInt64(&r.AggregateLimit, a.AggregateLimit)
+	setInt64(&r.InExcessOf, a.InExcessOf)
+}
+
+func setString(field *string, value *string) {
+	if value != nil {
+		*field = *value
+	}
+}
+
+func setInt64(field *int64, value *int64) {
+	if value != nil {
+		*field = *value
+	}
+}
+
+// Selects requests on their treaty terms. Empty strings and zero bounds
+// match everything.
+type RequestFilter struct {
+	ContractType    string `json:"contractType"`
+	ContractSubType string `json:"contractSubType"`
+	AssetType       string `json:"assetType"`
+	MinLimit        int64  `json:"minLimit"`
+	MaxLimit        int64  `json:"maxLimit"`
+	MinInsuredValue int64  `json:"minInsuredValue"`
+	MaxInsuredValue int64  `json:"maxInsuredValue"`
+	MaxAttachment   int64  `json:"maxAttachment"`
+	SortBy          string `json:"sortBy"` // one of the SORT_* fields, created when empty
+	Descending      bool   `json:"descending"`
+}
+
+const (
+	SORT_CREATED       = "created"
+	SORT_UPDATED       = "updated"
+	SORT_TIV           = "totalInsuredValue"
+	SORT_LIMIT         = "aggregateLimit"
+	SORT_ATTACHMENT    = "inExcessOf"
+	SORT_ASSET_TYPE    = "assetType"
+	SORT_CONTRACT_TYPE = "contractType"
+)
+
+func (f *RequestFilter) Decode(bytes []byte) error {
+	return json.Unmarshal(bytes, &f)
+}
+
+func IsValidSortField(field string) bool {
+	_, ok := requestSortKeys[field]
+	return ok || field == ""
+}
+
+func (f *RequestFilter) Matches(r ReinsuranceRequest) bool {
+	switch {
+	case f.ContractType != "" && f.ContractType != r.ContractType:
+		return false
+	case f.ContractSubType != "" && f.ContractSubType != r.ContractSubType:
+		return false
+	case f.AssetType != "" && f.AssetType != r.AssetType:
+		return false
+	case f.MinLimit != 0 && r.AggregateLimit < f.MinLimit:
+		return false
+	case f.MaxLimit != 0 && r.AggregateLimit > f.MaxLimit:
+		return false
+	case f.MinInsuredValue != 0 && r.TotalInsuredValue < f.MinInsuredValue:
+		return false
+	case f.MaxInsuredValue != 0 && r.TotalInsuredValue > f.MaxInsuredValue:
+		return false
+	case f.MaxAttachment != 0 && r.InExcessOf > f.MaxAttachment:
+		return false
+	}
+	return true
+}
+
+// Orders a before b for each sortable field
+var requestSortKeys = map[string]func(a, b *ReinsuranceRequest) bool{
+	SORT_CREATED:       func(a, b *ReinsuranceRequest) bool { return a.Created < b.Created },
+	SORT_UPDATED:       func(a, b *ReinsuranceRequest) bool { return a.Updated < b.Updated },
+	SORT_TIV:           func(a, b *ReinsuranceRequest) bool { return a.TotalInsuredValue < b.TotalInsuredValue },
+	SORT_LIMIT:         func(a, b *ReinsuranceRequest) bool { return a.AggregateLimit < b.AggregateLimit },
+	SORT_ATTACHMENT:    func(a, b *ReinsuranceRequest) bool { return a.InExcessOf < b.InExcessOf },
+	SORT_ASSET_TYPE:    func(a, b *ReinsuranceRequest) bool { return a.AssetType < b.AssetType },
+	SORT_CONTRACT_TYPE: func(a, b *ReinsuranceRequest) bool { return a.ContractType < b.ContractType },
+}
+
+// Returns the requests the filter matches, sorted as it asks. Ties keep
+// their given order.
+func (f *RequestFilter) Apply(requests []ReinsuranceRequest) []ReinsuranceRequest {
+	matched := make([]ReinsuranceRequest, 0)
+	for _, r := range requests {
+		if f.Matches(r) {
+			matched = append(matched, r)
+		}
+	}
+
+	sortBy := f.SortBy
+	if sortBy == "" {
+		sortBy = SORT_CREATED
+	}
+	sort.Stable(&requestSorter{matched, requestSortKeys[sortBy], f.Descending})
+	return matched
+}
+
+type requestSorter struct {
+	requests []ReinsuranceRequest
+	less     func(a, b *ReinsuranceRequest) bool
+	desc     bool
+}
+
+func (s *requestSorter) Len() int      { return len(s.requests) }
+func (s *requestSorter) Swap(i, j int) { s.requests[i], s.requests[j] = s.requests[j], s.requests[i] }
+func (s *requestSorter) Less(i, j int) bool {
+	if s.desc {
+		return s.less(&s.requests[j], &s.requests[i])
+	}
+	return s.less(&s.requests[i], &s.requests[j])
+}
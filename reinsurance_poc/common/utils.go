@@ -0,0 +1,66 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Returns the transaction timestamp in unix milliseconds. Unlike the local
+// clock this is the same on every peer executing the transaction.
+func GetTxTimeMillis(stub shim.ChaincodeStubInterface) (uint64, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get transaction timestamp due to : %s", err)
+	}
+	return uint64(ts.Seconds)*1000 + uint64(ts.Nanos)/1000000, nil
+}
+
+// Parses an RFC3339 time, as used for the ACA attribute validity, into unix
+// milliseconds. An empty string is an open bound and parses to 0.
+func ParseValidityTime(s string) (uint64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid validity time %s, expected RFC3339", s)
+	}
+	return uint64(t.UnixNano() / 1000000), nil
+}
+
+func ContainsString(values []string, value string) bool {
+	for _, e := range values {
+		if e == value {
+			return true
+		}
+	}
+	return false
+}
+
+// True if the transaction cert carries the admin role
+func IsAdmin(stub shim.ChaincodeStubInterface) bool {
+	ok, err := stub.VerifyAttribute(ROLE_ATTR, []byte(ADMIN_ROLE))
+	return err == nil && ok
+}
+
+// Splits the caller proof a chaincode appends to its cross-chaincode calls,
+// see AssetManagementCommunicator, off the args. The proof is "" when the
+// call carries none, e.g. when a user invokes the chaincode directly.
+func SplitCallerProof(args []string) ([]string, string) {
+	if len(args) == 0 || !strings.HasPrefix(args[len(args)-1], CALLER_PROOF_PREFIX) {
+		return args, ""
+	}
+	return args[:len(args)-1], strings.TrimPrefix(args[len(args)-1], CALLER_PROOF_PREFIX)
+}
+
+// The digest under which asset management registers a caller token, so the
+// token itself is never written to its state
+func HashCallerToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -4,21 +4,15 @@ import (
 	"errors"
 	"fmt"
 	// "encoding/json"
-	// "strconv"
-
-	"sync/atomic"
-	"time"
+	"strconv"
 
 	"strings"
 
 	"github.com/ajmanlove/hyperledger-sandbox/reinsurance_poc/common"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
-	"github.com/hyperledger/fabric/core/util"
 )
 
 var logger = shim.NewLogger("ReinsuranceProposalCC")
-var assetManagementCCId = ""
-var counter uint64 = 0
 var proposalPrefix = "BID"
 
 type ReinsuranceProposalCC struct {
@@ -29,22 +23,26 @@ type ReinsuranceProposal struct {
 }
 
 var amComm = common.AssetManagementCommunicator{}
+var idGen = common.IdGenerator{AMComm: &amComm}
+var reqComm = common.RequestCommunicator{AMComm: &amComm}
 
 func (t *ReinsuranceProposalCC) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 	logger.Debug("Init()")
 
-	if len(args) != 1 {
-		return nil, errors.New("Init expects expects asset management cc id as arg")
+	if len(args) != 2 {
+		return nil, errors.New("Init expects 2 args ['asset_management_cc_id', 'caller_token']")
 	}
-	assetManagementCCId = args[0]
-	amComm.CCName = assetManagementCCId
-
-	return nil, nil
+	err := amComm.SetCCName(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return nil, amComm.SetCallerToken(stub, args[1])
 }
 
 func (t *ReinsuranceProposalCC) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 
 	logger.Debug("enter Invoke")
+	args, proof := common.SplitCallerProof(args)
 	switch function {
 	case common.RP_PROPOSE_ARG:
 		return t.propose(stub, args)
@@ -54,12 +52,31 @@ func (t *ReinsuranceProposalCC) Invoke(stub shim.ChaincodeStubInterface, functio
 		return t.accept(stub, args)
 	case common.RP_REJECT_ARG:
 		return t.reject(stub, args)
+	case common.RP_VOID_ARG:
+		if len(args) != 1 {
+			return nil, errors.New("void_proposals requires 1 arg ['requestId']")
+		}
+		return nil, t.void_proposals(stub, args[0], proof)
+	case common.RP_FLAG_STALE_ARG:
+		if len(args) != 2 {
+			return nil, errors.New("flag_stale_proposals requires 2 args ['requestId', 'revision']")
+		}
+		revision, err := strconv.Atoi(args[1])
+		if err != nil {
+			return nil, errors.New("Invalid revision " + args[1])
+		}
+		return nil, t.flag_stale_proposals(stub, args[0], revision, proof)
+	case common.SET_AM_ARG:
+		return t.set_asset_management(stub, args)
+	case common.MIGRATE_ARG:
+		return t.migrate(stub)
 	default:
 		return nil, errors.New("Unrecognized Invoke function : " + function)
 	}
 }
 
 func (t *ReinsuranceProposalCC) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	args, _ = common.SplitCallerProof(args)
 
 	switch function {
 	case common.RP_GET_BID_ARG:
@@ -74,6 +91,12 @@ func (t *ReinsuranceProposalCC) Query(stub shim.ChaincodeStubInterface, function
 		}
 		return proposal.Encode()
 
+	case common.RP_GET_BIDS_ARG:
+		if len(args) == 0 {
+			return nil, errors.New("get_proposals requires at least 1 arg ['proposalId', ..]")
+		}
+		return t.get_proposals(stub, args)
+
 	default:
 		return nil, errors.New("Unrecognized Query function : " + function)
 	}
@@ -88,7 +111,10 @@ func (t *ReinsuranceProposalCC) propose(stub shim.ChaincodeStubInterface, args [
 
 	requestId := args[0]
 	contractText := args[1]
-	now := get_unix_millisec()
+	now, err := common.GetTxTimeMillis(stub)
+	if err != nil {
+		return nil, err
+	}
 
 	logger.Debug()
 
@@ -105,7 +131,21 @@ func (t *ReinsuranceProposalCC) propose(stub shim.ChaincodeStubInterface, args [
 	}
 
 	logger.Debug("Creating record...")
-	id := t.create_prop_id(requestId)
+	id, err := t.create_prop_id(stub, requestId)
+	if err != nil {
+		logger.Error(err)
+		return nil, errors.New("Failed to allocate proposal id for request " + requestId)
+	}
+
+	request, err := t.get_open_request(stub, requestId)
+	if err != nil {
+		return nil, err
+	}
+	err = reqComm.Transition(stub, requestId, common.REQ_QUOTING, id)
+	if err != nil {
+		logger.Error(err)
+		return nil, err
+	}
 	var record common.ReinsuranceBid
 	record.Init()
 
@@ -117,18 +157,18 @@ func (t *ReinsuranceProposalCC) propose(stub shim.ChaincodeStubInterface, args [
 	record.Updated = now
 	record.UpdatedBy = enrollmentId
 	record.Status = "bid" // TODO
+	record.RequestRevision = request.Revision
 
 	err = t.save_record(stub, id, record)
 	if err != nil {
 		return nil, err
 	}
 
-	invokeArgs := util.ToChaincodeArgs(common.AM_NEW_BID_ARG, id, requestId, enrollmentId, fmt.Sprintf("%d", now))
-	bytes, err := stub.InvokeChaincode(assetManagementCCId, invokeArgs)
+	bytes, err := amComm.Invoke(stub, common.AM_NEW_BID_ARG, id, requestId, enrollmentId, fmt.Sprintf("%d", now))
 
 	if err != nil {
 		logger.Error(err)
-		return nil, errors.New("Failed to manage new proposal asset " + id)
+		return nil, fmt.Errorf("Failed to manage new proposal asset %s due to : %s", id, err)
 	}
 
 	logger.Debugf("AM RESPONSE is %s", string(bytes))
@@ -142,7 +182,10 @@ func (t *ReinsuranceProposalCC) counter(stub shim.ChaincodeStubInterface, args [
 	}
 	proposalId := args[0]
 	contractText := args[1]
-	now := get_unix_millisec()
+	now, err := common.GetTxTimeMillis(stub)
+	if err != nil {
+		return nil, err
+	}
 	enrollmentId, err := amComm.GetEnrollmentAttr(stub)
 	if err != nil {
 		return nil, err
@@ -160,22 +203,34 @@ func (t *ReinsuranceProposalCC) counter(stub shim.ChaincodeStubInterface, args [
 		return nil, fmt.Errorf("Failed to get proposal %s due to : %s", proposalId, err)
 	}
 
+	request, err := t.get_open_request(stub, record.RequestId)
+	if err != nil {
+		return nil, err
+	}
+
+	onBehalfOf, err := t.get_acting_for(stub, proposalId, enrollmentId)
+	if err != nil {
+		return nil, err
+	}
+
 	record.ContractText = contractText
 	record.Updated = now
 	record.UpdatedBy = enrollmentId
+	record.UpdatedOnBehalfOf = onBehalfOf
 	record.Status = "counter" // TODO
+	record.RequestRevision = request.Revision
+	record.Stale = false
 
 	err = t.save_record(stub, proposalId, record)
 	if err != nil {
 		return nil, err
 	}
 
-	invokeArgs := util.ToChaincodeArgs(common.AM_NEW_CNTR_ARG, proposalId, enrollmentId, fmt.Sprintf("%d", now))
-	bytes, err := stub.InvokeChaincode(assetManagementCCId, invokeArgs)
+	bytes, err := amComm.Invoke(stub, common.AM_NEW_CNTR_ARG, proposalId, enrollmentId, fmt.Sprintf("%d", now))
 
 	if err != nil {
 		logger.Error(err)
-		return nil, errors.New("Failed to manage new counter asset " + proposalId)
+		return nil, fmt.Errorf("Failed to manage new counter asset %s due to : %s", proposalId, err)
 	}
 	logger.Debugf("AM RESPONSE is %s", string(bytes)) // TODO
 
@@ -189,7 +244,10 @@ func (t *ReinsuranceProposalCC) accept(stub shim.ChaincodeStubInterface, args []
 	}
 
 	proposalId := args[0]
-	now := get_unix_millisec()
+	now, err := common.GetTxTimeMillis(stub)
+	if err != nil {
+		return nil, err
+	}
 	enrollmentId, err := amComm.GetEnrollmentAttr(stub)
 	if err != nil {
 		return nil, err
@@ -206,8 +264,14 @@ func (t *ReinsuranceProposalCC) accept(stub shim.ChaincodeStubInterface, args []
 		return nil, fmt.Errorf("Failed to get proposal %s due to : %s", proposalId, err)
 	}
 
+	onBehalfOf, err := t.get_acting_for(stub, proposalId, enrollmentId)
+	if err != nil {
+		return nil, err
+	}
+
 	record.Updated = now
 	record.UpdatedBy = enrollmentId
+	record.UpdatedOnBehalfOf = onBehalfOf
 	record.Status = "accepted" // TODO
 
 	err = t.save_record(stub, proposalId, record)
@@ -216,15 +280,20 @@ func (t *ReinsuranceProposalCC) accept(stub shim.ChaincodeStubInterface, args []
 	}
 
 	// AM
-	invokeArgs := util.ToChaincodeArgs(common.AM_ACCEPT_ARG, proposalId, fmt.Sprintf("%d", now))
-	bytes, err := stub.InvokeChaincode(assetManagementCCId, invokeArgs)
+	bytes, err := amComm.Invoke(stub, common.AM_ACCEPT_ARG, proposalId, fmt.Sprintf("%d", now))
 	if err != nil {
 		logger.Error(err)
-		return nil, errors.New("Failed to manage acceptance " + proposalId)
+		return nil, fmt.Errorf("Failed to manage acceptance %s due to : %s", proposalId, err)
 	}
 	logger.Debugf("AM RESPONSE is %s", string(bytes)) // TODO
 
-	// TODO update the original submission
+	// Binds the original submission, fails unless it is still open
+	err = reqComm.Transition(stub, record.RequestId, common.REQ_BOUND, proposalId)
+	if err != nil {
+		logger.Error(err)
+		return nil, err
+	}
+
 	// TODO should this implicitly reject all other proposals?
 
 	return nil, nil
@@ -238,7 +307,10 @@ func (t *ReinsuranceProposalCC) reject(stub shim.ChaincodeStubInterface, args []
 	}
 
 	proposalId := args[0]
-	now := get_unix_millisec()
+	now, err := common.GetTxTimeMillis(stub)
+	if err != nil {
+		return nil, err
+	}
 	enrollmentId, err := amComm.GetEnrollmentAttr(stub)
 	if err != nil {
 		return nil, err
@@ -255,8 +327,19 @@ func (t *ReinsuranceProposalCC) reject(stub shim.ChaincodeStubInterface, args []
 		return nil, fmt.Errorf("Failed to get proposal %s due to : %s", proposalId, err)
 	}
 
+	_, err = t.get_open_request(stub, record.RequestId)
+	if err != nil {
+		return nil, err
+	}
+
+	onBehalfOf, err := t.get_acting_for(stub, proposalId, enrollmentId)
+	if err != nil {
+		return nil, err
+	}
+
 	record.Updated = now
 	record.UpdatedBy = enrollmentId
+	record.UpdatedOnBehalfOf = onBehalfOf
 	record.Status = "rejected" // TODO
 
 	err = t.save_record(stub, proposalId, record)
@@ -265,17 +348,172 @@ func (t *ReinsuranceProposalCC) reject(stub shim.ChaincodeStubInterface, args []
 	}
 
 	// AM
-	invokeArgs := util.ToChaincodeArgs(common.AM_REJECT_ARG, proposalId, fmt.Sprintf("%d", now))
-	bytes, err := stub.InvokeChaincode(assetManagementCCId, invokeArgs)
+	bytes, err := amComm.Invoke(stub, common.AM_REJECT_ARG, proposalId, fmt.Sprintf("%d", now))
 	if err != nil {
 		logger.Error(err)
-		return nil, errors.New("Failed to manage acceptance " + proposalId)
+		return nil, fmt.Errorf("Failed to manage rejection %s due to : %s", proposalId, err)
 	}
 	logger.Debugf("AM RESPONSE is %s", string(bytes)) // TODO
 
 	return nil, nil
 }
 
+// Bid statuses still awaiting an answer
+var openBidStatuses = map[string]bool{"bid": true, "counter": true}
+
+// Voids every open proposal on a request that was withdrawn, expired or
+// closed. Only reinsurance_request calls this, as part of the transition.
+func (t *ReinsuranceProposalCC) void_proposals(stub shim.ChaincodeStubInterface, requestId string, proof string) error {
+	err := assert_request_chaincode(stub, common.RP_VOID_ARG, proof)
+	if err != nil {
+		return err
+	}
+
+	enrollmentId, err := amComm.GetEnrollmentAttr(stub)
+	if err != nil {
+		return err
+	}
+	now, err := common.GetTxTimeMillis(stub)
+	if err != nil {
+		return err
+	}
+
+	records, err := t.get_request_proposals(stub, requestId)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if !openBidStatuses[record.Status] {
+			continue
+		}
+		record.Updated = now
+		record.UpdatedBy = enrollmentId
+		record.UpdatedOnBehalfOf = ""
+		record.Status = "voided"
+		err = t.save_record(stub, record.Id, record)
+		if err != nil {
+			return err
+		}
+		logger.Infof("Voided proposal %s of request %s", record.Id, requestId)
+	}
+	return nil
+}
+
+// Flags the open proposals quoted against a revision of the request older
+// than the given one. Only reinsurance_request calls this, when amending.
+func (t *ReinsuranceProposalCC) flag_stale_proposals(stub shim.ChaincodeStubInterface, requestId string, revision int, proof string) error {
+	err := assert_request_chaincode(stub, common.RP_FLAG_STALE_ARG, proof)
+	if err != nil {
+		return err
+	}
+
+	records, err := t.get_request_proposals(stub, requestId)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if !openBidStatuses[record.Status] || record.Stale || record.RequestRevision >= revision {
+			continue
+		}
+		record.Stale = true
+		err = t.save_record(stub, record.Id, record)
+		if err != nil {
+			return err
+		}
+		logger.Infof("Proposal %s quotes revision %d of request %s, now at %d", record.Id, record.RequestRevision, requestId, revision)
+	}
+	return nil
+}
+
+// Returns every proposal made on the request
+func (t *ReinsuranceProposalCC) get_request_proposals(stub shim.ChaincodeStubInterface, requestId string) ([]common.ReinsuranceBid, error) {
+	// Proposal ids extend the request id, see create_prop_id
+	prefix := fmt.Sprintf("%s-%s-", proposalPrefix, requestId)
+	iter, err := stub.RangeQueryState(prefix, prefix+"~")
+	if err != nil {
+		logger.Error(err)
+		return nil, errors.New("Failed to query proposals of request " + requestId)
+	}
+	defer iter.Close()
+
+	records := make([]common.ReinsuranceBid, 0)
+	for iter.HasNext() {
+		_, bytes, err := iter.Next()
+		if err != nil {
+			logger.Error(err)
+			return nil, errors.New("Failed to read proposals of request " + requestId)
+		}
+		var record common.ReinsuranceBid
+		err = record.Decode(bytes)
+		if err != nil {
+			logger.Error(err)
+			return nil, errors.New("Failed to deserialize a proposal of request " + requestId)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// Verifies the call carries the caller proof of the chaincode registered as
+// the request service, see AssetManagementCommunicator.VerifyCaller
+func assert_request_chaincode(stub shim.ChaincodeStubInterface, function string, proof string) error {
+	caller, err := amComm.VerifyCaller(stub, proof)
+	if err != nil {
+		logger.Error(err)
+		caller = "unverified caller"
+	}
+	if caller != common.SVC_REQUEST {
+		return &common.AuthorizationError{Function: function, Caller: caller, Reason: "only reinsurance_request may call"}
+	}
+	return nil
+}
+
+// Returns the request, failing unless it still takes proposals and answers
+// to them
+func (t *ReinsuranceProposalCC) get_open_request(stub shim.ChaincodeStubInterface, requestId string) (common.ReinsuranceRequest, error) {
+	request, err := reqComm.GetRequest(stub, requestId)
+	if err != nil {
+		logger.Error(err)
+		return request, err
+	}
+	if !common.IsOpenRequestStatus(request.Status) {
+		return request, fmt.Errorf("Request %s is %s and no longer takes proposals", requestId, request.Status)
+	}
+	return request, nil
+}
+
+// Rewrites every stored record at the current schema version
+func (t *ReinsuranceProposalCC) migrate(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	if !common.IsAdmin(stub) {
+		return nil, errors.New("migrate requires the admin role")
+	}
+	n, err := common.MigrateState(stub, proposalPrefix, func(bytes []byte) ([]byte, error) {
+		var record common.ReinsuranceBid
+		err := record.Decode(bytes)
+		if err != nil {
+			return nil, err
+		}
+		return record.Encode()
+	})
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("Migrated %d records", n)
+	return nil, nil
+}
+
+// Points the chaincode at a redeployed asset management, whose registry
+// resolves every other chaincode
+func (t *ReinsuranceProposalCC) set_asset_management(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Expects 1 arg ['asset_management_cc_id']")
+	}
+	if !common.IsAdmin(stub) {
+		return nil, errors.New("set_asset_management requires the admin role")
+	}
+	return nil, amComm.SetCCName(stub, args[0])
+}
+
 func (t *ReinsuranceProposalCC) get_proposal(stub shim.ChaincodeStubInterface, propId string) (common.ReinsuranceBid, error) {
 	// Rights
 	var r common.ReinsuranceBid
@@ -303,6 +541,49 @@ func (t *ReinsuranceProposalCC) get_proposal(stub shim.ChaincodeStubInterface, p
 	}
 }
 
+// Returns the requestor if the user is the broker acting for it on the proposal, otherwise ""
+func (t *ReinsuranceProposalCC) get_acting_for(stub shim.ChaincodeStubInterface, proposalId string, enrollmentId string) (string, error) {
+	info, err := amComm.GetAssetInfo(stub, proposalId)
+	if err != nil {
+		return "", err
+	}
+
+	isBroker := false
+	requestor := ""
+	for _, p := range info.Parties {
+		if p.Role == common.PARTY_BROKER && p.Id == enrollmentId {
+			isBroker = true
+		}
+		if p.Role == common.PARTY_REQUESTOR {
+			requestor = p.Id
+		}
+	}
+	if !isBroker {
+		return "", nil
+	}
+	return requestor, nil
+}
+
+// Fetches several proposals, checking the rights on all of them with a single
+// asset management query
+func (t *ReinsuranceProposalCC) get_proposals(stub shim.ChaincodeStubInterface, propIds []string) ([]byte, error) {
+	err := amComm.AssertHasAssetsRights(stub, propIds, []common.AssetRight{common.AVIEWER})
+	if err != nil {
+		return nil, err
+	}
+
+	response := common.ProposalsResponse{Proposals: make([]common.ReinsuranceBid, 0)}
+	for _, propId := range propIds {
+		proposal, err := t.get_proposal(stub, propId)
+		if err != nil {
+			logger.Error(err)
+			return nil, err
+		}
+		response.Proposals = append(response.Proposals, proposal)
+	}
+	return response.Encode()
+}
+
 func (t *ReinsuranceProposalCC) save_record(stub shim.ChaincodeStubInterface, id string, record common.ReinsuranceBid) error {
 	encoded, err := record.Encode()
 	if err != nil {
@@ -319,17 +600,9 @@ func (t *ReinsuranceProposalCC) save_record(stub shim.ChaincodeStubInterface, id
 	return nil
 }
 
-// TODO use stateful batching in case of restart
-// TODO id by enrollment id ? BID-[enrollId]-[requestId] ?
-func (t *ReinsuranceProposalCC) create_prop_id(requestId string) string {
-	c := atomic.AddUint64(&counter, 1)
-	return fmt.Sprintf("%s-%s-%d", proposalPrefix, requestId, c)
-}
-
-func get_unix_millisec() uint64 {
-	now := time.Now()
-	nanos := now.UnixNano()
-	return uint64(nanos / 1000000)
+// Proposal ids are numbered per request, i.e. BID-[requestId]-[n]
+func (t *ReinsuranceProposalCC) create_prop_id(stub shim.ChaincodeStubInterface, requestId string) (string, error) {
+	return idGen.NextId(stub, fmt.Sprintf("%s-%s", proposalPrefix, requestId))
 }
 
 // ============================================================================================================================
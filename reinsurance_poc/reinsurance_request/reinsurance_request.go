@@ -1,24 +1,24 @@
 package main
 
 import (
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
-	// "strconv"
+	"net/url"
+	"strconv"
 	"strings"
-	"sync/atomic"
-	"time"
 
 	"github.com/ajmanlove/hyperledger-sandbox/reinsurance_poc/common"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
-	"github.com/hyperledger/fabric/core/util"
 )
 
 var logger = shim.NewLogger("ReinsuranceRequestCC")
-var assetManagementCCId = ""
-var counter uint64 = 0
 var submissionPrefix = "REQ"
 
 var amComm = common.AssetManagementCommunicator{}
+var idGen = common.IdGenerator{AMComm: &amComm}
+var propComm = common.ProposalCommunicator{AMComm: &amComm}
 
 type ReinsuranceRequestCC struct {
 }
@@ -28,12 +28,14 @@ func (t *ReinsuranceRequestCC) Init(stub shim.ChaincodeStubInterface, function s
 
 	switch function {
 	case common.INIT_ARG:
-		if len(args) != 1 {
-			return nil, errors.New("Expects chaincode id for asset_management as init arg")
+		if len(args) != 2 {
+			return nil, errors.New("Expects 2 init args ['asset_management_cc_id', 'caller_token']")
+		}
+		err := amComm.SetCCName(stub, args[0])
+		if err != nil {
+			return nil, err
 		}
-		assetManagementCCId = args[0]
-		amComm.CCName = assetManagementCCId
-		return nil, nil
+		return nil, amComm.SetCallerToken(stub, args[1])
 	default:
 		return nil, errors.New("Unrecognized Init function: " + function)
 	}
@@ -41,23 +43,78 @@ func (t *ReinsuranceRequestCC) Init(stub shim.ChaincodeStubInterface, function s
 }
 
 func (t *ReinsuranceRequestCC) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	logger.Debugf("enter Invoke, function: [%s], args [%s]", function, args)
+	logger.Debugf("enter Invoke, function: [%s]", function)
+	args, proof := common.SplitCallerProof(args)
 	switch function {
 	case common.RR_SUBMIT_ARG:
 		return t.submit(stub, args)
+	case common.RR_SUBMIT_JSON_ARG:
+		return t.submit_json(stub, args)
+	case common.RR_AMEND_ARG:
+		if len(args) != 2 {
+			return nil, errors.New("amend requires 2 args ['requestId', 'amendmentJson']")
+		}
+		return nil, t.amend(stub, args[0], args[1])
+	case common.RR_INVITE_ARG:
+		if len(args) != 2 {
+			return nil, errors.New("invite requires 2 args ['requestId', 'requestees,..']")
+		}
+		return nil, t.invite(stub, args[0], strings.Split(args[1], ","))
+	case common.RR_WITHDRAW_ARG:
+		if len(args) != 1 && len(args) != 2 {
+			return nil, errors.New("withdraw requires 1 or 2 args ['requestId', 'reason']")
+		}
+		reason := ""
+		if len(args) == 2 {
+			reason = args[1]
+		}
+		return nil, t.withdraw(stub, args[0], reason)
+	case common.RR_EXPIRE_ARG:
+		if len(args) != 1 && len(args) != 2 {
+			return nil, errors.New("expire requires 1 or 2 args ['requestId', 'reason']")
+		}
+		reason := ""
+		if len(args) == 2 {
+			reason = args[1]
+		}
+		return nil, t.expire(stub, args[0], reason)
+	case common.RR_TRANSITION_ARG:
+		if len(args) != 2 && len(args) != 3 {
+			return nil, errors.New("transition requires 2 or 3 args ['requestId', 'status', 'reason']")
+		}
+		reason := ""
+		if len(args) == 3 {
+			reason = args[2]
+		}
+		return nil, t.transition(stub, args[0], args[1], reason, proof)
+	case common.SET_AM_ARG:
+		return t.set_asset_management(stub, args)
+	case common.MIGRATE_ARG:
+		return t.migrate(stub)
 	default:
 		return nil, errors.New("Unrecognized Invoke function: " + function)
 	}
 }
 
 func (t *ReinsuranceRequestCC) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	logger.Debugf("enter Query, function: [%s], args [%s]", function, args)
+	logger.Debugf("enter Query, function: [%s]", function)
+	args, _ = common.SplitCallerProof(args)
 	switch function {
 	case common.RR_GET_REQ_ARG:
 		if len(args) != 1 {
 			return nil, errors.New("Expected 1 arg, asset id")
 		}
 		return t.get_request(stub, args)
+	case common.RR_GET_VERSIONS_ARG:
+		if len(args) != 1 && len(args) != 2 {
+			return nil, errors.New("get_request_versions requires 1 or 2 args ['requestId', 'revision']")
+		}
+		return t.get_request_versions(stub, args)
+	case common.RR_FIND_REQS_ARG:
+		if len(args) != 2 {
+			return nil, errors.New("find_requests requires 2 args ['requestId,..', 'filterJson']")
+		}
+		return t.find_requests(stub, strings.Split(args[0], ","), args[1])
 	default:
 		return nil, errors.New("Unrecognized Invoke function: " + function)
 	}
@@ -68,83 +125,609 @@ func (t *ReinsuranceRequestCC) get_request(stub shim.ChaincodeStubInterface, arg
 	err := amComm.AssertHasAssetRights(stub, requestId, []common.AssetRight{common.AVIEWER})
 	if err != nil {
 		return nil, err
-	} else {
-		return stub.GetState(requestId) // TODO visibility
+	}
+
+	// TODO visibility
+	request, err := t.load_request(stub, requestId)
+	if err != nil {
+		return nil, err
+	}
+	return request.Encode()
+}
+
+// Returns every revision of a request, oldest first, or with a revision arg
+// only that one
+func (t *ReinsuranceRequestCC) get_request_versions(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	requestId := args[0]
+	err := amComm.AssertHasAssetRights(stub, requestId, []common.AssetRight{common.AVIEWER})
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := t.load_request(stub, requestId)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(args) == 2 {
+		revision, err := strconv.Atoi(args[1])
+		if err != nil || revision < 1 || revision > current.Revision {
+			return nil, fmt.Errorf("Request %s has no revision %s", requestId, args[1])
+		}
+		if revision == current.Revision {
+			return current.Encode()
+		}
+		request, err := t.load_request(stub, revision_key(requestId, revision))
+		if err != nil {
+			return nil, err
+		}
+		return request.Encode()
+	}
+
+	response := common.RequestsResponse{Requests: make([]common.ReinsuranceRequest, 0)}
+	for revision := 1; revision < current.Revision; revision++ {
+		request, err := t.load_request(stub, revision_key(requestId, revision))
+		if err != nil {
+			return nil, err
+		}
+		response.Requests = append(response.Requests, request)
+	}
+	response.Requests = append(response.Requests, current)
+	return response.Encode()
+}
+
+func (t *ReinsuranceRequestCC) load_request(stub shim.ChaincodeStubInterface, requestId string) (common.ReinsuranceRequest, error) {
+	var request common.ReinsuranceRequest
+	bytes, err := stub.GetState(requestId)
+	if err != nil {
+		logger.Error(err)
+		return request, errors.New("Failed to get request " + requestId)
+	}
+	if bytes == nil {
+		return request, errors.New("No such request " + requestId)
+	}
+	err = request.Decode(bytes)
+	if err != nil {
+		logger.Error(err)
+		return request, errors.New("Failed to deserialize request " + requestId)
+	}
+	return request, nil
+}
 
+// Returns those of the given requests whose treaty terms match the filter,
+// sorted on the filter's field
+func (t *ReinsuranceRequestCC) find_requests(stub shim.ChaincodeStubInterface, requestIds []string, filterJson string) ([]byte, error) {
+	var filter common.RequestFilter
+	err := filter.Decode([]byte(filterJson))
+	if err != nil {
+		logger.Error(err)
+		return nil, fmt.Errorf("Failed to parse filter due to : %s", err)
 	}
+	if !common.IsValidSortField(filter.SortBy) {
+		return nil, errors.New("Cannot sort requests on " + filter.SortBy)
+	}
+
+	err = amComm.AssertHasAssetsRights(stub, requestIds, []common.AssetRight{common.AVIEWER})
+	if err != nil {
+		return nil, err
+	}
+
+	requests := make([]common.ReinsuranceRequest, 0)
+	for _, requestId := range requestIds {
+		request, err := t.load_request(stub, requestId)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, request)
+	}
+
+	response := common.RequestsResponse{Requests: filter.Apply(requests)}
+	return response.Encode()
 }
 
 func (t *ReinsuranceRequestCC) submit(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	logger.Debug("submit()")
+	if len(args) != 6 && len(args) != 7 {
+		return nil, errors.New("Requires 6 or 7 args: ['requestees,..', 'portfolioSha', 'portfolioUrl', 'contractText', 'schema', 'schemaVersion', 'onBehalfOf']")
+	}
 
-	id := t.get_new_submission_id()
-	requestees := strings.Split(args[0], ",")
-	portfolioSha := args[1]
-	portfolioUrl := args[2]
-	contractText := args[3]
-	schema := args[4]
-	schemaVersion := args[5]
-	status := "requested"
-	bytes, err := stub.ReadCertAttribute("enrollmentId")
-	now := get_unix_millisec()
+	rr := common.ReinsuranceRequest{
+		Requestees:   strings.Split(args[0], ","),
+		PortfolioSHA: args[1],
+		PortfolioURL: args[2],
+		ContractText: args[3],
+		ISQLSchema:   args[4],
+		ISQLVersion:  args[5],
+	}
+	onBehalfOf := ""
+	if len(args) == 7 {
+		onBehalfOf = args[6]
+	}
+	return nil, t.submit_request(stub, rr, onBehalfOf, false)
+}
 
+// Submits a request given as one JSON document in the shape of
+// common.ReinsuranceRequest. Only the portfolio, contract, schema, treaty
+// terms and requestee fields are taken from it, plus requestor when a broker
+// submits on a cedent's behalf. Unlike the positional submit, the treaty
+// terms are required.
+func (t *ReinsuranceRequestCC) submit_json(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Debug("submit_json()")
+	if len(args) != 1 {
+		return nil, errors.New("Requires 1 arg: ['requestJson']")
+	}
+
+	var doc common.ReinsuranceRequest
+	err := json.Unmarshal([]byte(args[0]), &doc)
 	if err != nil {
 		logger.Error(err)
-		return nil, errors.New("failed to get enrollmentId attribute")
+		return nil, fmt.Errorf("Failed to parse request document due to : %s", err)
 	}
-	requestor := string(bytes)
 
 	rr := common.ReinsuranceRequest{
-		Id:           id,
-		Requestor:    requestor,
-		Requestees:   requestees,
-		PortfolioSHA: portfolioSha,
-		PortfolioURL: portfolioUrl,
-		ContractText: contractText,
-		ISQLSchema:   schema,
-		ISQLVersion:  schemaVersion,
-		Status:       status,
-		Created:      now,
-		Updated:      now,
+		Requestees:   doc.Requestees,
+		PortfolioSHA: doc.PortfolioSHA,
+		PortfolioURL: doc.PortfolioURL,
+		ContractText: doc.ContractText,
+		ISQLSchema:   doc.ISQLSchema,
+		ISQLVersion:  doc.ISQLVersion,
+		TreatyTerms:  doc.TreatyTerms,
+	}
+	return nil, t.submit_request(stub, rr, doc.Requestor, true)
+}
+
+// Validates and stores a new request, then notes it with asset management.
+// A non empty onBehalfOf other than the caller makes the caller the broker.
+// With requireTerms missing treaty terms are validation errors too.
+func (t *ReinsuranceRequestCC) submit_request(stub shim.ChaincodeStubInterface, rr common.ReinsuranceRequest, onBehalfOf string, requireTerms bool) error {
+	bytes, err := stub.ReadCertAttribute("enrollmentId")
+	if err != nil {
+		logger.Error(err)
+		return errors.New("failed to get enrollmentId attribute")
+	}
+	submitter := string(bytes)
+	requestor := submitter
+
+	// A broker submits for the cedent that mandated it, asset management
+	// checks the mandate
+	broker := ""
+	if onBehalfOf != "" && onBehalfOf != requestor {
+		broker = requestor
+		requestor = onBehalfOf
+	}
+	rr.Requestor = requestor
+	rr.Broker = broker
+
+	verr := validate_request(rr, requestor, broker, requireTerms)
+	if len(verr) > 0 {
+		logger.Errorf("Rejected invalid request : %s", verr)
+		return verr
+	}
+
+	id, err := t.get_new_submission_id(stub)
+	if err != nil {
+		logger.Error(err)
+		return errors.New("Failed to allocate submission id")
+	}
+	now, err := common.GetTxTimeMillis(stub)
+	if err != nil {
+		return err
 	}
 
+	rr.Id = id
+	rr.Status = common.REQ_REQUESTED
+	rr.Revision = 1
+	rr.Created = now
+	rr.Updated = now
+	rr.Transitions = []common.StatusTransition{{To: rr.Status, At: now, By: submitter}}
+
 	// Submit
 	bytes, err = rr.Encode()
 	if err != nil {
 		logger.Error(err)
-		return nil, errors.New("Failed to serialize request")
+		return errors.New("Failed to serialize request")
 	}
 
 	err = stub.PutState(id, bytes)
 	if err != nil {
 		logger.Error(err)
-		return nil, errors.New("Failed to submit request")
+		return errors.New("Failed to submit request")
 	}
 
 	// Note with asset management
-	invokeArgs := util.ToChaincodeArgs(common.AM_NEW_REQ_ARG, id, requestor, strings.Join(requestees, ","), fmt.Sprintf("%d", now))
-	response, err := stub.InvokeChaincode(assetManagementCCId, invokeArgs)
+	amArgs := []string{common.AM_NEW_REQ_ARG, id, requestor, strings.Join(rr.Requestees, ","), fmt.Sprintf("%d", now)}
+	if broker != "" {
+		amArgs = append(amArgs, broker)
+	}
+	response, err := amComm.Invoke(stub, amArgs...)
 	if err != nil {
 		logger.Error(err)
-		return nil, errors.New("failed to manage new request")
+		return fmt.Errorf("failed to manage new request due to : %s", err)
 	}
 
 	logger.Debugf("Asset management response is %s", string(response))
-	logger.Debugf("Asset management error is %s", err)
+	return nil
+}
+
+// Hex digest lengths accepted for the portfolio hash, md5 through sha512
+var digestLengths = map[int]bool{32: true, 40: true, 64: true, 128: true}
+
+// Checks every field of a new request, collecting all failures. The treaty
+// terms are checked when given or when requireTerms is set.
+func validate_request(rr common.ReinsuranceRequest, requestor string, broker string, requireTerms bool) common.ValidationErrors {
+	verr := common.ValidationErrors{}
+
+	if len(rr.Requestees) == 0 {
+		verr.Add("requestees", "at least one requestee is required")
+	}
+	seen := make(map[string]bool)
+	for i, r := range rr.Requestees {
+		field := fmt.Sprintf("requestees[%d]", i)
+		switch {
+		case strings.TrimSpace(r) == "":
+			verr.Add(field, "requestee is empty")
+		case r == requestor:
+			verr.Add(field, "the requestor cannot be a requestee")
+		case broker != "" && r == broker:
+			verr.Add(field, "the submitting broker cannot be a requestee")
+		case seen[r]:
+			verr.Add(field, "duplicate requestee "+r)
+		}
+		seen[r] = true
+	}
+
+	if !digestLengths[len(rr.PortfolioSHA)] {
+		verr.Add("portfolioSha", "expected a hex digest of 32, 40, 64 or 128 characters")
+	} else if _, err := hex.DecodeString(rr.PortfolioSHA); err != nil {
+		verr.Add("portfolioSha", "digest is not hexadecimal")
+	}
+
+	u, err := url.ParseRequestURI(rr.PortfolioURL)
+	if err != nil {
+		verr.Add("portfolioUrl", "not a valid URL : "+err.Error())
+	} else if u.Scheme == "" || u.Host == "" {
+		verr.Add("portfolioUrl", "URL requires a scheme and host")
+	}
+
+	if rr.ISQLSchema == "" {
+		verr.Add("iSQLSchema", "schema is required")
+	}
+	if rr.ISQLVersion == "" {
+		verr.Add("iSQLVersion", "schema version is required")
+	}
+
+	if requireTerms || rr.HasTerms() {
+		rr.Validate(&verr)
+	}
+	return verr
+}
+
+// Statuses reinsurance_proposal moves a request to as proposals are made and
+// accepted. The others are the requestor's to set.
+var proposalTransitions = map[string]bool{
+	common.REQ_QUOTING: true,
+	common.REQ_BOUND:   true,
+}
+
+// Moves a request along its lifecycle. Quoting and bound are only reachable
+// from reinsurance_proposal, withdrawn only through withdraw and expired only
+// through expire. Closing needs ownership of the request and voids the
+// proposals left open beside the accepted one. Moving to the current status
+// again is a no-op, so every proposal may report quoting.
+func (t *ReinsuranceRequestCC) transition(stub shim.ChaincodeStubInterface, requestId string, status string, reason string, proof string) error {
+	if !common.IsValidRequestStatus(status) {
+		return errors.New("Unknown request status " + status)
+	}
+	if status == common.REQ_WITHDRAWN {
+		return errors.New("Requests are withdrawn with " + common.RR_WITHDRAW_ARG)
+	}
+	if status == common.REQ_EXPIRED {
+		return errors.New("Requests are expired with " + common.RR_EXPIRE_ARG)
+	}
+
+	caller, err := amComm.GetEnrollmentAttr(stub)
+	if err != nil {
+		return err
+	}
+
+	if proposalTransitions[status] {
+		err = assert_proposal_chaincode(stub, status, proof)
+	} else {
+		err = amComm.AssertHasAssetRights(stub, requestId, []common.AssetRight{common.AOWNER})
+	}
+	if err != nil {
+		return err
+	}
+
+	request, err := t.load_request(stub, requestId)
+	if err != nil {
+		return err
+	}
+	if request.Status == status {
+		return nil
+	}
+
+	now, err := common.GetTxTimeMillis(stub)
+	if err != nil {
+		return err
+	}
+	err = request.Transition(status, now, caller, reason)
+	if err != nil {
+		return err
+	}
+	err = t.save_request(stub, request)
+	if err != nil {
+		return err
+	}
+
+	if status == common.REQ_CLOSED {
+		err = propComm.VoidProposals(stub, requestId)
+		if err != nil {
+			logger.Error(err)
+			return err
+		}
+	}
+
+	logger.Infof("Request %s moved to %s by %s", requestId, status, caller)
+	return nil
+}
+
+// Replaces the portfolio, contract, schema or treaty terms of an open request
+// field by field with those given in a common.RequestAmendment document. The
+// replaced revision is kept and open proposals are flagged as quoting an
+// older revision.
+func (t *ReinsuranceRequestCC) amend(stub shim.ChaincodeStubInterface, requestId string, amendmentJson string) error {
+	err := amComm.AssertHasAssetRights(stub, requestId, []common.AssetRight{common.AOWNER})
+	if err != nil {
+		return err
+	}
+
+	var doc common.RequestAmendment
+	err = doc.Decode([]byte(amendmentJson))
+	if err != nil {
+		logger.Error(err)
+		return fmt.Errorf("Failed to parse amendment due to : %s", err)
+	}
+
+	request, err := t.load_request(stub, requestId)
+	if err != nil {
+		return err
+	}
+	if !common.IsOpenRequestStatus(request.Status) {
+		return fmt.Errorf("Request %s is %s and can no longer be amended", requestId, request.Status)
+	}
+
+	amended := request
+	doc.Apply(&amended)
+
+	verr := validate_request(amended, amended.Requestor, amended.Broker, false)
+	if len(verr) > 0 {
+		logger.Errorf("Rejected invalid amendment : %s", verr)
+		return verr
+	}
+
+	// Keep the replaced revision
+	bytes, err := request.Encode()
+	if err != nil {
+		logger.Error(err)
+		return errors.New("Failed to serialize request")
+	}
+	err = stub.PutState(revision_key(requestId, request.Revision), bytes)
+	if err != nil {
+		logger.Error(err)
+		return errors.New("Failed to save revision of request " + requestId)
+	}
+
+	now, err := common.GetTxTimeMillis(stub)
+	if err != nil {
+		return err
+	}
+	amended.Revision = request.Revision + 1
+	amended.Updated = now
+	err = t.save_request(stub, amended)
+	if err != nil {
+		return err
+	}
+
+	if request.Status == common.REQ_QUOTING {
+		err = propComm.FlagStaleProposals(stub, requestId, amended.Revision)
+		if err != nil {
+			logger.Error(err)
+			return err
+		}
+	}
+
+	logger.Infof("Request %s amended to revision %d", requestId, amended.Revision)
+	return nil
+}
+
+// Adds requestees to an open request. Asset management gives them the
+// reinsurer role on it and notes the request in their assets.
+func (t *ReinsuranceRequestCC) invite(stub shim.ChaincodeStubInterface, requestId string, invitees []string) error {
+	err := amComm.AssertHasAssetRights(stub, requestId, []common.AssetRight{common.AOWNER})
+	if err != nil {
+		return err
+	}
+
+	request, err := t.load_request(stub, requestId)
+	if err != nil {
+		return err
+	}
+	if !common.IsOpenRequestStatus(request.Status) {
+		return fmt.Errorf("Request %s is %s and no longer takes requestees", requestId, request.Status)
+	}
+
+	verr := common.ValidationErrors{}
+	for i, invitee := range invitees {
+		field := fmt.Sprintf("requestees[%d]", i)
+		switch {
+		case strings.TrimSpace(invitee) == "":
+			verr.Add(field, "requestee is empty")
+		case invitee == request.Requestor:
+			verr.Add(field, "the requestor cannot be a requestee")
+		case request.Broker != "" && invitee == request.Broker:
+			verr.Add(field, "the submitting broker cannot be a requestee")
+		case common.ContainsString(request.Requestees, invitee) || common.ContainsString(invitees[:i], invitee):
+			verr.Add(field, invitee+" is already a requestee")
+		}
+	}
+	if len(verr) > 0 {
+		logger.Errorf("Rejected invalid invitation : %s", verr)
+		return verr
+	}
+
+	now, err := common.GetTxTimeMillis(stub)
+	if err != nil {
+		return err
+	}
+	request.Requestees = append(request.Requestees, invitees...)
+	request.Updated = now
+	err = t.save_request(stub, request)
+	if err != nil {
+		return err
+	}
 
+	_, err = amComm.Invoke(stub, common.AM_INVITED_ARG, requestId, strings.Join(invitees, ","), fmt.Sprintf("%d", now))
+	if err != nil {
+		logger.Error(err)
+		return fmt.Errorf("failed to manage invitation to %s due to : %s", requestId, err)
+	}
+
+	logger.Infof("Invited %s to request %s", strings.Join(invitees, ","), requestId)
+	return nil
+}
+
+// State key of a replaced revision of a request
+func revision_key(requestId string, revision int) string {
+	return fmt.Sprintf("%s/rev/%d", requestId, revision)
+}
+
+// Pulls a request from the market. Its open proposals are voided and the
+// requestees lose sight of it.
+func (t *ReinsuranceRequestCC) withdraw(stub shim.ChaincodeStubInterface, requestId string, reason string) error {
+	err := amComm.AssertHasAssetRights(stub, requestId, []common.AssetRight{common.AOWNER})
+	if err != nil {
+		return err
+	}
+	return t.retire(stub, requestId, common.REQ_WITHDRAWN, common.AM_WITHDRAWN_ARG, reason)
+}
+
+// Ends a request that found no taker in time. Like a withdrawal its open
+// proposals are voided and the requestees lose sight of it. Needs ownership
+// of the request or the admin role.
+func (t *ReinsuranceRequestCC) expire(stub shim.ChaincodeStubInterface, requestId string, reason string) error {
+	if !common.IsAdmin(stub) {
+		err := amComm.AssertHasAssetRights(stub, requestId, []common.AssetRight{common.AOWNER})
+		if err != nil {
+			return err
+		}
+	}
+	return t.retire(stub, requestId, common.REQ_EXPIRED, common.AM_EXPIRED_ARG, reason)
+}
+
+// Moves an open request to a final status, voids its open proposals and has
+// asset management revoke the requestees through amArg
+func (t *ReinsuranceRequestCC) retire(stub shim.ChaincodeStubInterface, requestId string, status string, amArg string, reason string) error {
+	caller, err := amComm.GetEnrollmentAttr(stub)
+	if err != nil {
+		return err
+	}
+
+	request, err := t.load_request(stub, requestId)
+	if err != nil {
+		return err
+	}
+	now, err := common.GetTxTimeMillis(stub)
+	if err != nil {
+		return err
+	}
+	err = request.Transition(status, now, caller, reason)
+	if err != nil {
+		return err
+	}
+	err = t.save_request(stub, request)
+	if err != nil {
+		return err
+	}
+
+	err = propComm.VoidProposals(stub, requestId)
+	if err != nil {
+		logger.Error(err)
+		return err
+	}
+
+	_, err = amComm.Invoke(stub, amArg, requestId, fmt.Sprintf("%d", now))
+	if err != nil {
+		logger.Error(err)
+		return fmt.Errorf("failed to manage %s request %s due to : %s", status, requestId, err)
+	}
+
+	logger.Infof("Request %s %s by %s", requestId, status, caller)
+	return nil
+}
+
+func (t *ReinsuranceRequestCC) save_request(stub shim.ChaincodeStubInterface, request common.ReinsuranceRequest) error {
+	bytes, err := request.Encode()
+	if err != nil {
+		logger.Error(err)
+		return errors.New("Failed to serialize request")
+	}
+	err = stub.PutState(request.Id, bytes)
+	if err != nil {
+		logger.Error(err)
+		return errors.New("Failed to save request " + request.Id)
+	}
+	return nil
+}
+
+// Verifies the call carries the caller proof of the chaincode registered as
+// the proposal service, see AssetManagementCommunicator.VerifyCaller
+func assert_proposal_chaincode(stub shim.ChaincodeStubInterface, status string, proof string) error {
+	caller, err := amComm.VerifyCaller(stub, proof)
+	if err != nil {
+		logger.Error(err)
+		caller = "unverified caller"
+	}
+	if caller != common.SVC_PROPOSAL {
+		return &common.AuthorizationError{Function: common.RR_TRANSITION_ARG, Caller: caller, Reason: "only reinsurance_proposal moves a request to " + status}
+	}
+	return nil
+}
+
+// Rewrites every stored record at the current schema version
+func (t *ReinsuranceRequestCC) migrate(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	if !common.IsAdmin(stub) {
+		return nil, errors.New("migrate requires the admin role")
+	}
+	n, err := common.MigrateState(stub, submissionPrefix, func(bytes []byte) ([]byte, error) {
+		var record common.ReinsuranceRequest
+		err := record.Decode(bytes)
+		if err != nil {
+			return nil, err
+		}
+		return record.Encode()
+	})
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("Migrated %d records", n)
 	return nil, nil
 }
 
-// TODO use stateful batching in case of restart
-func (t *ReinsuranceRequestCC) get_new_submission_id() string {
-	c := atomic.AddUint64(&counter, 1)
-	return fmt.Sprintf("%s-%d", submissionPrefix, c)
+// Points the chaincode at a redeployed asset management, whose registry
+// resolves every other chaincode
+func (t *ReinsuranceRequestCC) set_asset_management(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Expects 1 arg ['asset_management_cc_id']")
+	}
+	if !common.IsAdmin(stub) {
+		return nil, errors.New("set_asset_management requires the admin role")
+	}
+	return nil, amComm.SetCCName(stub, args[0])
 }
 
-func get_unix_millisec() uint64 {
-	now := time.Now()
-	nanos := now.UnixNano()
-	return uint64(nanos / 1000000)
+func (t *ReinsuranceRequestCC) get_new_submission_id(stub shim.ChaincodeStubInterface) (string, error) {
+	return idGen.NextId(stub, submissionPrefix)
 }
 
 // ============================================================================================================================
@@ -1,3 +1,4 @@
+import binascii
 import os
 from subprocess import check_call
 import sys
@@ -62,10 +63,15 @@ def init_hyperledger():
 
     print("Asset chaincode name is " + asset_cc_name)
 
+    # Each chaincode proves its calls to the others with a caller token, given
+    # to it at deploy time and registered with asset_management
+    request_token = new_caller_token()
+    proposal_token = new_caller_token()
+
     request_cc_name = deploy_chaincode(
         c, setup_hl_creds[0],
         "https://github.com/ajmanlove/hyperledger-sandbox/reinsurance_poc/reinsurance_request",
-        [asset_cc_name]
+        [asset_cc_name, request_token]
     )
 
     print("Request chaincode name is " + request_cc_name)
@@ -73,7 +79,7 @@ def init_hyperledger():
     proposal_cc_name = deploy_chaincode(
         c, setup_hl_creds[0],
         "https://github.com/ajmanlove/hyperledger-sandbox/reinsurance_poc/reinsurance_proposal",
-        [asset_cc_name]
+        [asset_cc_name, proposal_token]
     )
 
     print("Enrolling test users...")
@@ -83,8 +89,10 @@ def init_hyperledger():
     register_hl_user(insurer2_hl_creds[0], insurer2_hl_creds[1])
     register_hl_user(reinsurer3_hl_creds[0], reinsurer3_hl_creds[1])
 
-    register_cc(asset_cc_name, setup_hl_creds[0], request_cc_name, "reinsurance_request")
-    register_cc(asset_cc_name, setup_hl_creds[0], proposal_cc_name, "reinsurance_proposal")
+    # Chaincodes resolve each other through the asset_management service
+    # registry, only asset_management itself is passed at deploy time
+    register_cc(asset_cc_name, setup_hl_creds[0], request_cc_name, "reinsurance_request", request_token)
+    register_cc(asset_cc_name, setup_hl_creds[0], proposal_cc_name, "reinsurance_proposal", proposal_token)
 
     print("Writing setup meta file...")
     f = open(".setup.ini", 'w')
@@ -104,8 +112,11 @@ def init_hyperledger():
     print("")
     print("Init of hyperledger environment COMPLETE")
 
-def register_cc(am_name, user, cc_name, identifier):
-    print("Registering chaincode {} as {}".format(cc_name, identifier))
+def new_caller_token():
+    return binascii.hexlify(os.urandom(32)).decode("ascii")
+
+def register_cc(am_name, user, cc_name, service_name, token):
+    print("Registering chaincode {} as {}".format(cc_name, service_name))
     data = {
       "jsonrpc": "2.0",
       "method": "invoke",
@@ -116,10 +127,10 @@ def register_cc(am_name, user, cc_name, identifier):
         },
         "ctorMsg": {
           "function": "register_chaincode",
-          "args": [cc_name, identifier]
+          "args": [cc_name, service_name, token]
         },
         "secureContext": user,
-        "attributes": ["enrollmentId", "contact"]
+        "attributes": ["enrollmentId", "role"]
       },
       "id": 3
     }